@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/plan-systems/klog"
@@ -14,6 +15,11 @@ import (
 
 func main() {
 
+	hostGrpcPort := flag.Int("port", int(repo.Const_DefaultGrpcServicePort), "Sets the port used to bind the Repo service")
+	dataDir := flag.String("data", "", "Specifies the path for all file access and storage")
+	peerAddr := flag.String("peer", "", "Address of a peer pnode to replicate with (e.g. \"10.0.0.7:5190\")")
+	peerDomains := flag.String("domains", "", "Comma separated domain names to replicate with -peer")
+
 	flag.Parse()
 	flag.Set("logtostderr", "true")
 	flag.Set("v", "2")
@@ -33,11 +39,25 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defaultDataDir := path.Join(exePath, "PLAN.data")
-	
-	hostGrpcPort := *flag.Int("port", int(repo.Const_DefaultGrpcServicePort), "Sets the port used to bind the Repo service")
+	if len(*dataDir) == 0 {
+		*dataDir = path.Join(exePath, "PLAN.data")
+	}
+
 	params := repo.HostParams{
-		BasePath: *flag.String("data", defaultDataDir, "Specifies the path for all file access and storage"),
+		BasePath: *dataDir,
+	}
+
+	if len(*peerAddr) > 0 {
+		var domainNames []string
+		for _, domainName := range strings.Split(*peerDomains, ",") {
+			if domainName = strings.TrimSpace(domainName); len(domainName) > 0 {
+				domainNames = append(domainNames, domainName)
+			}
+		}
+		if len(domainNames) == 0 {
+			log.Fatal("-peer requires -domains")
+		}
+		params.Vaults = append(params.Vaults, repo.NewGrpcVault(*peerAddr, domainNames))
 	}
 
 	host, err := repo.NewHost(params)
@@ -53,7 +73,7 @@ func main() {
 	// Fun fact: using "127.0.0.1" specifically binds to localhost, so incoming outside connections will be refused.
 	// Later, when pnode is embedded in the client app for each platform, we'll want to use 127.0.0.1 (or IPC).
 	// Until then, we want to need to accept incoming outside connections.
-	srv := repo.NewGrpcServer(host, "tcp", fmt.Sprintf("0.0.0.0:%v", hostGrpcPort))
+	srv := repo.NewGrpcServer(host, "tcp", fmt.Sprintf("0.0.0.0:%v", *hostGrpcPort))
 	err = srv.Start()
 	if err != nil {
 		srv.Fatalf("failed to start: %v", err)
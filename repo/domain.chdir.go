@@ -0,0 +1,293 @@
+package repo
+
+import (
+	"strings"
+
+	"github.com/plan-systems/plan-go/bufs"
+	"github.com/plan-systems/plan-go/ctx"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// chDirKeypath is the reserved keypath (under a domain's keyspace) where the ChInfo of each channel is stored, keyed by channel ID.
+const chDirKeypath = "/.chdir/"
+
+// chDirSubBacklog is the number of channel directory changes queued for a chDirSub before it is considered to have fallen behind.
+const chDirSubBacklog = 64
+
+// chDirSub lists the channels of a domain (see ChReqOp_ListChannels) and then optionally remains open for channels added or renamed.
+//
+// Delivery is at-least-once: a channel added or renamed while the directory is being read may be sent twice.
+type chDirSub struct {
+	ctx.Context
+
+	domain     *domain
+	chReq      *ChReq
+	search     string
+	nodeOutbox chan *Node
+	inbox      chan *ChInfo
+}
+
+// chDirKey returns the db key of the directory entry for the given channel.
+func (d *domain) chDirKey(chID string) []byte {
+	key := make([]byte, 0, len(d.keyPrefix)+len(chDirKeypath)+len(chID))
+	return append(append(append(key, d.keyPrefix...), chDirKeypath...), chID...)
+}
+
+// updateChDir updates the directory entry of the given channel (within the given db txn) if the given Tx creates it or renames it
+// (via the given entries applied to it), returning the updated ChInfo (or nil if it was not changed).
+//
+// Since a channel's genesis and renames can be merged in any order, the existing entry is updated rather than replaced:
+// a genesis only sets the creator fields, and the name is always that of the channel's current (last-writer-wins) ChNameKeypath node.
+func (d *domain) updateChDir(dbTx *badger.Txn, tx *Tx, target *chSess, uri *ChStateURI, isGenesis bool, applied []*Node) (*ChInfo, error) {
+	renamed := false
+	for _, entry := range applied {
+		if entry.Keypath == ChNameKeypath {
+			renamed = true
+		}
+	}
+	if !isGenesis && !renamed {
+		return nil, nil
+	}
+
+	info, err := d.readChInfo(dbTx, uri.ChID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		info = &ChInfo{
+			ChID:     uri.ChID,
+			ChID_TID: uri.ChID_TID,
+		}
+	}
+
+	if isGenesis {
+		info.CreatorPubKey = tx.Signer
+		info.TimeCreatedFS = int64(TID(tx.TID).ExtractTimeFS())
+	}
+
+	info.Name, err = target.readChName(dbTx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = dbTx.Set(d.chDirKey(info.ChID), bufs.SmartMarshal(info, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// readChName returns the name of this channel as currently stored at ChNameKeypath (or "" if it has none or it was removed).
+func (ch *chSess) readChName(dbTx *badger.Txn) (string, error) {
+	item, err := dbTx.Get(AppendChKey(append([]byte{}, ch.keyPrefix...), ChNameKeypath))
+	if err == badger.ErrKeyNotFound {
+		return "", nil
+	}
+
+	var name Node
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			return unmarshalStoredNode(val, &name)
+		})
+	}
+	if err != nil || name.Op != NodeOp_NodeUpdate {
+		return "", err
+	}
+	return name.Str, nil
+}
+
+// readChInfo returns the directory entry of the given channel (or nil if the channel has none).
+func (d *domain) readChInfo(dbTx *badger.Txn, chID string) (*ChInfo, error) {
+	item, err := dbTx.Get(d.chDirKey(chID))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+
+	info := &ChInfo{}
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			return info.Unmarshal(val)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// checkChExists returns an error unless the genesis of the given channel has been merged.
+//
+// Where a Tx is authored (isLocal), writing to a channel that doesn't exist is an error (ErrCode_InvalidURI).
+// A replica, however, may receive a Tx writing to a channel before it receives that channel's genesis,
+// so ErrCode_ChNotFound is returned instead, leaving the Tx to await the genesis (see domain.awaitGenesis).
+func (d *domain) checkChExists(dbTx *badger.Txn, chID string, isLocal bool) error {
+	info, err := d.readChInfo(dbTx, chID)
+	if err != nil {
+		return ErrCode_CommitFailed.Wrap(err)
+	}
+	if info == nil || len(info.CreatorPubKey) == 0 {
+		if isLocal {
+			return ErrCode_InvalidURI.ErrWithMsgf("channel %v not found", chID)
+		}
+		return ErrCode_ChNotFound.ErrWithMsgf("channel %v not found", chID)
+	}
+	return nil
+}
+
+// OpenChDir -- see interface Domain
+func (d *domain) OpenChDir(chReq *ChReq) (ChSub, error) {
+	sub := &chDirSub{
+		domain:     d,
+		chReq:      chReq,
+		nodeOutbox: make(chan *Node),
+	}
+
+	if chReq.ChDirOp != nil {
+		sub.search = strings.ToLower(chReq.ChDirOp.NameContains)
+		if chReq.ChDirOp.MaintainSync {
+			sub.inbox = make(chan *ChInfo, chDirSubBacklog)
+		}
+	}
+
+	err := sub.CtxStart(
+		sub.ctxStartup,
+		nil,
+		nil,
+		sub.ctxStopping,
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.CtxAddChild(sub, nil)
+
+	return sub, nil
+}
+
+func (d *domain) registerChDirSub(sub *chDirSub) {
+	d.chDirSubsMu.Lock()
+	d.chDirSubs = append(d.chDirSubs, sub)
+	d.chDirSubsMu.Unlock()
+}
+
+func (d *domain) unregisterChDirSub(remove *chDirSub) {
+	d.chDirSubsMu.Lock()
+	N := len(d.chDirSubs)
+	for i := 0; i < N; i++ {
+		if d.chDirSubs[i] == remove {
+			N--
+			d.chDirSubs[i] = d.chDirSubs[N]
+			d.chDirSubs[N] = nil
+			d.chDirSubs = d.chDirSubs[:N]
+			break
+		}
+	}
+	d.chDirSubsMu.Unlock()
+}
+
+// broadcastChDirChanges sends each given newly committed ChInfo to each chDirSub maintaining sync.
+// A sub that has fallen behind is stopped (rather than blocking the merge loop), leaving its consumer to reopen it.
+func (d *domain) broadcastChDirChanges(infos []*ChInfo) {
+	d.chDirSubsMu.RLock()
+	for _, sub := range d.chDirSubs {
+		for _, info := range infos {
+			select {
+			case sub.inbox <- info:
+			default:
+				go sub.CtxStop("channel directory sub fell behind", nil)
+			}
+		}
+	}
+	d.chDirSubsMu.RUnlock()
+}
+
+// Outbox -- see interface ChSub
+func (sub *chDirSub) Outbox() <-chan *Node {
+	return sub.nodeOutbox
+}
+
+// Close -- see interface ChSub
+func (sub *chDirSub) Close() {
+	sub.CtxStop("channel directory sub cancelled", nil)
+}
+
+func (sub *chDirSub) ctxStartup() error {
+	sub.SetLogLabelf("sub%03d %s channels", sub.chReq.ReqID, sub.domain.domainName)
+
+	// Register before reading the directory so that no newly added channels are missed
+	if sub.inbox != nil {
+		sub.domain.registerChDirSub(sub)
+	}
+
+	sub.CtxGo(func() {
+		sub.sendDir()
+
+		if sub.inbox != nil {
+			sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_ChSyncResume, nil)
+
+			for info := range sub.inbox {
+				sub.send(info)
+			}
+		}
+
+		close(sub.nodeOutbox)
+
+		if sub.inbox == nil {
+			sub.CtxStop("channel directory sent", nil)
+		}
+	})
+
+	return nil
+}
+
+func (sub *chDirSub) ctxStopping() {
+	if sub.inbox != nil {
+		sub.domain.unregisterChDirSub(sub)
+		close(sub.inbox)
+	}
+}
+
+// sendDir sends the ChInfo of each channel in the domain's directory that matches this sub's search.
+func (sub *chDirSub) sendDir() {
+	d := sub.domain
+	dirPrefix := d.chDirKey("")
+
+	readTxn := d.stateDB.NewTransaction(false)
+	defer readTxn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = dirPrefix
+	itr := readTxn.NewIterator(opts)
+	defer itr.Close()
+
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		if sub.CtxRunning() == false {
+			break
+		}
+
+		info := &ChInfo{}
+		err := itr.Item().Value(func(val []byte) error {
+			return info.Unmarshal(val)
+		})
+		if err != nil {
+			sub.Errorf("failed to read channel directory entry %v: %v", string(itr.Item().Key()[len(dirPrefix):]), err)
+			continue
+		}
+
+		sub.send(info)
+	}
+}
+
+// send sends the given ChInfo to the client if it matches this sub's search.
+func (sub *chDirSub) send(info *ChInfo) {
+	if len(sub.search) > 0 && strings.Contains(strings.ToLower(info.Name), sub.search) == false {
+		return
+	}
+
+	node := sub.chReq.newResponse(NodeOp_ChInfo, nil)
+	node.ChID = info.ChID
+	node.Str = info.Name
+	node.Attachment = bufs.SmartMarshal(info, node.Attachment)
+	sub.nodeOutbox <- node
+}
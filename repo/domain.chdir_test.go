@@ -0,0 +1,112 @@
+package repo
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+func TestChDirGenesisKeepsName(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, genesis := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: ChNameKeypath, Str: "general"}))
+
+	d, err := A.(*host).holdDomain(testDomain, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.(*host).releaseDomain(d)
+	ch, err := d.holdChSess(uri.ChID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer atomic.AddInt32(&ch.txsPending, -1)
+
+	// A genesis merged after a rename (e.g. arriving late at a replica) only sets the creator fields
+	signer := testSigner(t, genesis)
+	var info *ChInfo
+	err = d.stateDB.Update(func(dbTx *badger.Txn) error {
+		var err error
+		info, err = d.updateChDir(dbTx, &Tx{TID: genesis.TID, Signer: signer}, ch, uri, true, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "general" || bytes.Equal(info.CreatorPubKey, signer) == false {
+		t.Fatalf("expected channel 'general' created by %v, got %+v", signer, info)
+	}
+}
+
+func TestListChannels(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	newTestChannel(t, A, alice, &Node{Keypath: ChNameKeypath, Str: "General Chat"})
+	random, _ := newTestChannel(t, A, alice, &Node{Keypath: ChNameKeypath, Str: "random"})
+
+	for search, expect := range map[string]string{"": "General Chat random", "GENERAL": "General Chat", "none": ""} {
+		sub, err := A.OpenChDir(&ChReq{
+			ChStateURI: &ChStateURI{DomainName: testDomain},
+			ChDirOp:    &ChDirOp{NameContains: search},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for node := range sub.Outbox() {
+			if node.Op == NodeOp_ChInfo {
+				names = append(names, node.Str)
+			}
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != expect {
+			t.Errorf("%q: expected %q, got %q", search, expect, got)
+		}
+	}
+
+	// A sub maintaining sync is sent each channel renamed or added
+	sub, err := A.OpenChDir(&ChReq{
+		ChStateURI: &ChStateURI{DomainName: testDomain},
+		ChDirOp:    &ChDirOp{MaintainSync: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	readChDirUntil(t, sub, NodeOp_ChSyncResume)
+
+	submitTestTx(t, A, signTestTx(t, alice, random, &Node{Keypath: ChNameKeypath, Str: "news"}))
+	if node := readChDirUntil(t, sub, NodeOp_ChInfo); node.ChID != random.ChID || node.Str != "news" {
+		t.Fatalf("expected %v to be renamed 'news', got %v %q", random.ChID, node.ChID, node.Str)
+	}
+	added, _ := newTestChannel(t, A, alice, &Node{Keypath: ChNameKeypath, Str: "added"})
+	if node := readChDirUntil(t, sub, NodeOp_ChInfo); node.ChID != added.ChID || node.Str != "added" {
+		t.Fatalf("expected %v to be added, got %v %q", added.ChID, node.ChID, node.Str)
+	}
+}
+
+// readChDirUntil returns the next node with the given op sent by the given channel directory sub.
+func readChDirUntil(t *testing.T, sub ChSub, op NodeOp) *Node {
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case node, ok := <-sub.Outbox():
+			if !ok {
+				t.Fatalf("sub closed before %v", op)
+			}
+			if node.Op == op {
+				return node
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", op)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package repo
+
+import (
+	"regexp"
+)
+
+// nodeFilters narrows the nodes a chSub sends to those whose keypath and TypeID match the patterns given in its GetOp.
+type nodeFilters struct {
+	regexKeypath *regexp.Regexp
+	regexTypeID  *regexp.Regexp
+}
+
+// compile sets up these filters from the given GetOp, leaving a filter nil if its pattern is not set.
+func (filters *nodeFilters) compile(getOp *GetOp) error {
+	var err error
+
+	if len(getOp.KeypathRegex) > 0 {
+		filters.regexKeypath, err = regexp.Compile(getOp.KeypathRegex)
+		if err != nil {
+			return ErrCode_InvalidKeypath.ErrWithMsgf("invalid KeypathRegex: %v", err)
+		}
+	}
+
+	if len(getOp.TypeIDRegex) > 0 {
+		filters.regexTypeID, err = regexp.Compile(getOp.TypeIDRegex)
+		if err != nil {
+			return ErrCode_UnsupporteReqOp.ErrWithMsgf("invalid TypeIDRegex: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// matchKeypath returns true if the given (channel relative) keypath passes the keypath filter.
+func (filters *nodeFilters) matchKeypath(keypath string) bool {
+	return filters.regexKeypath == nil || filters.regexKeypath.MatchString(keypath)
+}
+
+// matchTypeID returns true if the given TypeID passes the TypeID filter.
+func (filters *nodeFilters) matchTypeID(typeID string) bool {
+	return filters.regexTypeID == nil || filters.regexTypeID.MatchString(typeID)
+}
+
+// matchChange returns true if the given change to a node within a chSub's scope should be sent to the client.
+//
+// Since a removal doesn't carry the removed node's TypeID, it is only filtered by keypath, and a NodeRemoveAll always passes
+// (as it may remove matching nodes below it). An update that changes a node's TypeID to one that no longer matches is not sent.
+func (filters *nodeFilters) matchChange(change *Node) bool {
+	switch change.Op {
+	case NodeOp_NodeRemoveAll:
+		return true
+	case NodeOp_NodeRemove:
+		return filters.matchKeypath(change.Keypath)
+	}
+	return filters.matchKeypath(change.Keypath) && filters.matchTypeID(change.TypeID)
+}
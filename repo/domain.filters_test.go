@@ -0,0 +1,74 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestNodeFilters(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice,
+		&Node{Keypath: "posts/a", TypeID: "text/plain"},
+		&Node{Keypath: "posts/b", TypeID: "image/png"},
+		&Node{Keypath: "posts/cc", TypeID: "text/html"},
+	)
+
+	tests := []struct {
+		keypathRegex string
+		typeIDRegex  string
+		expect       string
+	}{
+		{"", "", "posts/a posts/b posts/cc"},
+		{"^posts/.$", "", "posts/a posts/b"},
+		{"", "^text/", "posts/a posts/cc"},
+		{"^posts/.$", "^text/", "posts/a"},
+	}
+	for _, test := range tests {
+		nodes := readNodes(t, A, alice, &ChReq{
+			ChStateURI: uri,
+			GetOp: &GetOp{
+				Keypath:      "posts",
+				Scope:        KeypathScope_Shallow,
+				KeypathRegex: test.keypathRegex,
+				TypeIDRegex:  test.typeIDRegex,
+			},
+		})
+		if got := joinKeypaths(nodes); got != test.expect {
+			t.Errorf("%q %q: expected %q, got %q", test.keypathRegex, test.typeIDRegex, test.expect, got)
+		}
+	}
+
+	// Changes are filtered the same as state
+	sub := openTestSub(t, A, alice, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:      "posts",
+			Scope:        KeypathScope_Shallow,
+			TypeIDRegex:  "^text/",
+			MaintainSync: true,
+		},
+	})
+	submitTestTx(t, A, signTestTx(t, alice, uri,
+		&Node{Keypath: "posts/image", TypeID: "image/gif"},
+		&Node{Keypath: "posts/text", TypeID: "text/plain"},
+	))
+	for _, node := range readSubUntil(t, sub, "posts/text") {
+		if node.Keypath == "posts/image" {
+			t.Fatal("expected posts/image to be filtered")
+		}
+	}
+
+	// An invalid pattern is rejected
+	_, err := A.OpenChSub(&ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:      "posts",
+			Scope:        KeypathScope_Shallow,
+			KeypathRegex: "(",
+		},
+	}, alice)
+	if err == nil {
+		t.Fatal("expected an invalid KeypathRegex to be rejected")
+	}
+}
@@ -2,69 +2,180 @@ package repo
 
 import (
 	"bytes"
-	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	//"github.com/plan-systems/plan-go/bufs"
+	"github.com/plan-systems/plan-go/bufs"
 	"github.com/plan-systems/plan-go/ctx"
+	"github.com/plan-systems/plan-go/device"
+	"github.com/plan-systems/plan-go/ski"
 
 	"github.com/dgraph-io/badger/v3"
 )
 
-// LID is the local assigned ID, an integer assigned the given channel for brevity and look
-type LID uint32
+// quarantineKeypath is the reserved keypath (under a domain's keyspace) where rejected txns are stored for inspection.
+const quarantineKeypath = "/.quarantine/"
+
+// revStampSz is the byte size of a revStamp
+const revStampSz = 8 + TIDSz
+
+// revStamp is the sortable revision of a node stored in a channel: the node's big endian RevID followed by the TID of the tx that wrote it.
+// Each stored node value is prefixed with its revStamp so that revisions are compared without unmarshalling.
+//
+// Of two revisions of the same keypath, the greater revStamp wins, so the tx TID serves as the tiebreaker for equal RevIDs.
+type revStamp [revStampSz]byte
+
+// set sets this revStamp to the given RevID and TID.
+func (rev *revStamp) set(revID int64, tid TID) {
+
+	// Flip the sign bit so that negative RevIDs sort before positive ones
+	TID(rev[:8]).SetTimeFS(device.TimeFS(uint64(revID) ^ (1 << 63)))
+	copy(rev[8:], tid)
+}
+
+// RevID returns the RevID contained in this revStamp.
+func (rev *revStamp) RevID() int64 {
+	return int64(uint64(TID(rev[:8]).ExtractTimeFS()) ^ (1 << 63))
+}
+
+// isNewerRev returns true if no node is stored at the given key or if the stored node's revStamp precedes the given revStamp.
+func isNewerRev(dbTx *badger.Txn, key []byte, rev *revStamp) (bool, error) {
+	item, err := dbTx.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	isNewer := false
+	err = item.Value(func(val []byte) error {
+		isNewer = len(val) < revStampSz || bytes.Compare(rev[:], val[:revStampSz]) > 0
+		return nil
+	})
+	return isNewer, err
+}
+
+// marshalStoredNode returns the given node marshalled into a newly allocated buffer, prefixed with the given revStamp.
+func marshalStoredNode(rev *revStamp, node *Node) []byte {
+	buf := make([]byte, revStampSz+node.Size())
+	copy(buf, rev[:])
+	node.MarshalToSizedBuffer(buf[revStampSz:])
+	return buf
+}
+
+// metaTombstone is set in the badger UserMeta of each live channel key holding a tombstone (see marshalTombstone).
+// This allows removed nodes to be skipped without reading their values.
+const metaTombstone = byte(1 << 0)
+
+// unmarshalStoredNode unmarshals a node value stored in a channel (see revStamp).
+func unmarshalStoredNode(val []byte, node *Node) error {
+	if len(val) < revStampSz {
+		return ErrCode_TxMalformed.ErrWithMsg("stored node missing revStamp")
+	}
+	return node.Unmarshal(val[revStampSz:])
+}
 
 // domain is the top level interface for a community's channels.
 type domain struct {
 	ctx.Context
 
 	domainName      string
+	lid             LID
+	keyPrefix       []byte // leads every db key of this domain (its LID)
 	host            *host
 	stateDB         *badger.DB
+	chLIDs          lidTable // maps each ChID (and channel alias) to its channel's LID
 	chSessMu        sync.RWMutex
-	chSess          map[string]*chSess
+	chSess          map[LID]*chSess
+	chSessStopped   bool  // set once this domain begins stopping, after which no chSess is mounted (guarded by chSessMu)
+	holds           int32 // callers using this domain (see host.holdDomain), accessed atomically
 	txsToMerge      chan *Tx
-	txsToDecode     chan *RawTx
-	writeScrap      []byte
+	txsToDecode     chan *RawTx // nil once this domain is stopping
+	txsToDecodeMu   sync.RWMutex
+	feeds           []*txFeed
+	feedsMu         sync.RWMutex
+	domainSubs      []*domainSub
+	domainSubsMu    sync.RWMutex
+	chDirSubs       []*chDirSub
+	chDirSubsMu     sync.RWMutex
+	commitMu        sync.Mutex            // orders merge commits (and their merge seqs) and their delivery to subs and feeds
+	mergeSeq        uint64                // merge seq of the last tx sent to be committed (guarded by commitMu)
+	commits         []*pendingCommit      // commits sent to the db but not yet delivered, in commit order (guarded by commitMu)
+	pendingTxs      map[string]*pendingTx // keyed by TID
+	pendingTxsMu    sync.Mutex
+	awaitingGenesis []*Tx // txns received ahead of the genesis of a channel they write to (see awaitGenesis)
+	awaitingMu      sync.Mutex
 	chAutoStopDelay time.Duration
 }
 
 type chSess struct {
 	ctx.Context
 
-	//LID       LID
+	lid          LID
 	stateDB      *badger.DB
 	domain       *domain
 	ChID         string
 	keyPrefix    ChKey
 	keyPrefixBuf [255]byte
+	histPrefix   []byte
 	subs         []*chSub
 	subsMu       sync.RWMutex
+	txsToMerge   chan *Tx
+	txsPending   int32     // txns queued for this chSess but not yet merged (accessed atomically)
+	writeScrap   []byte    // used by this chSess's merge worker
+	scrap        []byte    // unused remainder of writeScrap during a commit
+	dirChanges   []*ChInfo // channel directory entries written during a commit
 }
 
+const (
+
+	// mergeBatchMaxTxs is the max number of queued txns a chSess merges in a single db commit.
+	mergeBatchMaxTxs = 64
+
+	// mergeBatchMaxSz is the total RawTx byte size at which a chSess stops adding queued txns to a commit.
+	mergeBatchMaxSz = 1 << 20
+)
+
+// chSubBacklog is the number of merged commits queued for a chSub before it is considered to have fallen behind.
+const chSubBacklog = 16
+
 type chSub struct {
 	ctx.Context
 
 	chSess          *chSess
 	chReq           *ChReq
+	reader          []byte // pub key of the member reading (see checkReadAccess)
 	nodeOutbox      chan *Node
-	txInbox         chan *Tx
+	txInbox         chan *mergedTxs
+	asOf            *revStamp
+	asOfVersion     uint64 // if set, the db version that revisions read as of asOf must have been committed by
+	scope           subScope
+	filters         nodeFilters
+	snapshotVersion uint64 // db version of the state snapshot sent to the client
+	outOfSync       int32  // set (atomically) when merged txns could not be queued for this sub
 	clientSuspended bool
+	syncWindow      time.Duration  // if set, live changes are sent in batches, each followed by a SyncStep
+	pending         []*Node        // changes queued for the next batch (superseded changes are nil)
+	pendingIdx      map[string]int // index of the queued change for each keypath (if coalescing updates)
 }
 
 func newDomain(
+	lid LID,
 	domainName string,
 	host *host,
 ) *domain {
 
 	d := &domain{
 		domainName:      domainName,
+		lid:             lid,
+		keyPrefix:       appendLIDKey(nil, lid),
 		stateDB:         host.stateDB,
 		host:            host,
-		chSess:          make(map[string]*chSess),
-		writeScrap:      make([]byte, 32000),
+		chSess:          make(map[LID]*chSess),
+		pendingTxs:      make(map[string]*pendingTx),
 		chAutoStopDelay: 60 * time.Second,
 	}
 
@@ -89,7 +200,7 @@ func newDomain(
 func (d *domain) Start() error {
 	err := d.CtxStart(
 		d.ctxStartup,
-		nil,
+		d.ctxStopIssued,
 		d.onChSessStopping,
 		d.ctxStopping,
 	)
@@ -100,26 +211,30 @@ func (d *domain) ctxStartup() error {
 
 	d.Infof(1, "starting")
 
+	d.chLIDs.open(d.stateDB, d.host.lidSeq, d.keyPrefix, chLIDsKeypath)
+
+	var err error
+	d.mergeSeq, err = d.readMergeSeq()
+	if err != nil {
+		return err
+	}
+
 	//
 	//
 	//
 	//
 	// inbound Tx to merge
 	//
+	// Each tx is passed to its channel's merge worker so that channels merge in parallel
 	d.txsToMerge = make(chan *Tx, 1)
 	d.CtxGo(func() {
 		for tx := range d.txsToMerge {
-			chSess, err := d.getChSess(tx.TxOp.ChStateURI.ChID, true)
-			if chSess != nil {
-				err = chSess.mergeTx(tx)
-			}
+			err := d.queueTxToMerge(tx)
 			if err != nil {
-				d.Warnf("merge error for Tx %v: %v", TID(tx.TID).SuffixStr(), err)
-				continue
+				d.rejectTx(tx.RawTx, err)
 			}
-
-			chSess.broadcastToSubs(tx)
 		}
+		d.completeAllTxs(ErrCode_ReqCanceled.ErrWithMsg("domain stopped"))
 		d.Info(1, "shutdown complete")
 	})
 	//
@@ -128,31 +243,22 @@ func (d *domain) ctxStartup() error {
 	//
 	// inbound RawTx to unpack/decode/decrypt
 	//
-	// Decodes incoming raw txns and inserts them into the collator, which reassembles txn segments into the original (entries).
+	// Verifies and decodes incoming raw txns and forwards them to be merged.  Rejected txns are quarantined.
 	d.txsToDecode = make(chan *RawTx, 1)
 	d.CtxGo(func() {
+		unpacker := ski.NewUnpacker(false)
 
-		// TODO: choose different txn decoder based on spInfo
-		//txnDecoder := ds.NewTxnDecoder(false)
-
-		for txIn := range d.txsToDecode {
-
-			d.Warnf("dropping RawTx %v", TID(txIn.TID).SuffixStr())
-			// txnSet, err := CR.txnCollater.DecodeAndCollateTxn(txnDecoder, &txnIn)
-			// if err != nil {
-			//     CR.Warnf("error processing txn %v: %v", txnIn.URID, err)
-			// } else if txnSet != nil {
-			//     payloadCodec := txnSet.PayloadCodec()
+		for rawTx := range d.txsToDecode {
+			tx, err := DecodeRawTx(rawTx, &unpacker)
+			if err == nil && d.host.isDomainName(tx.TxOp.ChStateURI.DomainName, d) == false {
+				err = ErrCode_InvalidURI.ErrWithMsgf("tx domain name %q does not match", tx.TxOp.ChStateURI.DomainName)
+			}
+			if err != nil {
+				d.rejectTx(rawTx, err)
+				continue
+			}
 
-			//     switch payloadCodec {
-			//         case plan.EntryCryptCodec:
-			//             entry := newChEntry(entryFromStorageProvider)
-			//             entry.PayloadTxnSet = txnSet
-			//             CR.entriesToMerge <- entry
-			//         default:
-			//             CR.Warn("encountered unhandled payload multicodec: ", payloadCodec)
-			//     }
-			// }
+			d.txsToMerge <- tx
 		}
 
 		close(d.txsToMerge)
@@ -177,11 +283,22 @@ func (d *domain) onChSessStopping(child ctx.Ctx) {
 	}
 }
 
+// ctxStopIssued stops any further chSess from being mounted, since a chSess mounted once this domain has stopped its children would outlive it.
+// A tx still in this domain's pipeline is then canceled rather than merged (see queueTxToMerge).
+func (d *domain) ctxStopIssued() {
+	d.chSessMu.Lock()
+	d.chSessStopped = true
+	d.chSessMu.Unlock()
+}
+
 func (d *domain) ctxStopping() {
 
 	// Don't we have to wait for the vaultMgr ctx to be done before proceeding?
 	// Trick question: it's a child ctx, this ctx won't be given the signal to stop until vaultMgr is stopped.
+	d.txsToDecodeMu.Lock()
 	close(d.txsToDecode)
+	d.txsToDecode = nil
+	d.txsToDecodeMu.Unlock()
 }
 
 // DomainName -- see interface Domain
@@ -204,34 +321,106 @@ func (d *domain) DomainName() string {
 //     d.subsMu.Unlock()
 // }
 
-func (d *domain) getChSess(chID string, autoMount bool) (*chSess, error) {
+// lookupCh returns the LID of the channel with the given ChID or alias.
+//
+// Only merging a tx issues a channel its LID (see resolveCh), so reading a channel never seen here fails with ErrCode_ChNotFound rather than growing the db.
+func (d *domain) lookupCh(chID string) (LID, error) {
+	if len(chID) == 0 {
+		return 0, ErrCode_InvalidURI.ErrWithMsg("missing channel ID")
+	}
+
+	lid, err := d.chLIDs.lookup(chID)
+	if err == nil && lid == 0 {
+		return 0, ErrCode_ChNotFound.ErrWithMsg(chID)
+	}
+	return lid, err
+}
+
+// resolveCh returns the LID of the channel with the given ChID or alias, issuing a LID to a ChID seen for the first time.
+func (d *domain) resolveCh(chID string) (LID, error) {
+	if len(chID) == 0 {
+		return 0, ErrCode_InvalidURI.ErrWithMsg("missing channel ID")
+	}
+
+	lid, err := d.chLIDs.lookup(chID)
+	if err == nil && lid == 0 {
+		if isChID(chID) == false {
+			return 0, ErrCode_InvalidURI.ErrWithMsgf("unknown channel alias %q", chID)
+		}
+		lid, err = d.chLIDs.issue(chID)
+	}
+	return lid, err
+}
+
+// AliasCh -- see interface Domain
+func (d *domain) AliasCh(uri *ChStateURI, alias string) error {
+	if isChID(alias) {
+		return ErrCode_InvalidURI.ErrWithMsgf("alias %q has the form of a channel ID", alias)
+	}
+
+	lid, err := d.lookupCh(uri.ChID)
+	if err != nil {
+		return err
+	}
+
+	return d.chLIDs.alias(alias, lid, false)
+}
+
+// getChSess returns the chSess for the given channel, mounting it as needed.
+// If autoIssue is set, a channel seen for the first time is issued a LID (see resolveCh).
+func (d *domain) getChSess(chID string, autoIssue bool) (*chSess, error) {
+	var (
+		lid LID
+		err error
+	)
+	if autoIssue {
+		lid, err = d.resolveCh(chID)
+	} else {
+		lid, err = d.lookupCh(chID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	d.chSessMu.RLock()
-	ch := d.chSess[chID]
+	ch := d.chSess[lid]
 	d.chSessMu.RUnlock()
 
-	if ch != nil || autoMount == false {
+	if ch != nil {
 		return ch, nil
 	}
 
-	return d.mountChSess(chID)
+	return d.mountChSess(lid)
 }
 
-func (d *domain) mountChSess(chID string) (*chSess, error) {
+func (d *domain) mountChSess(lid LID) (*chSess, error) {
 	d.chSessMu.Lock()
 	defer d.chSessMu.Unlock()
 
-	ch := d.chSess[chID]
+	ch := d.chSess[lid]
 	if ch != nil {
 		return ch, nil
 	}
+	if d.chSessStopped {
+		return nil, ErrCode_ReqCanceled.ErrWithMsg("domain stopping")
+	}
+
+	// A channel is always known by the ChID it was issued a LID for, even when mounted via an alias
+	chID, err := d.chLIDs.primaryName(lid)
+	if err != nil {
+		return nil, err
+	}
 
 	ch = &chSess{
-		stateDB: d.stateDB,
-		domain:  d,
-		ChID:    chID,
+		lid:        lid,
+		stateDB:    d.stateDB,
+		domain:     d,
+		ChID:       chID,
+		txsToMerge: make(chan *Tx, mergeBatchMaxTxs),
+		writeScrap: make([]byte, 32000),
 	}
 
-	err := ch.CtxStart(
+	err = ch.CtxStart(
 		ch.ctxStartup,
 		nil,
 		ch.onChSubStopping,
@@ -241,7 +430,7 @@ func (d *domain) mountChSess(chID string) (*chSess, error) {
 		return nil, err
 	}
 
-	d.chSess[chID] = ch
+	d.chSess[lid] = ch
 
 	// Make the chSess a child ctx of the domain
 	d.CtxAddChild(ch, nil)
@@ -249,282 +438,1329 @@ func (d *domain) mountChSess(chID string) (*chSess, error) {
 	return ch, nil
 }
 
+// queueTxToMerge passes the given tx to the merge worker of its channel, mounting the channel as needed.
+func (d *domain) queueTxToMerge(tx *Tx) error {
+	ch, err := d.holdChSess(tx.TxOp.ChStateURI.ChID)
+	if err != nil {
+
+		// A tx that can't be merged because this domain is stopping is canceled rather than rejected
+		if toReqErr(err).Code == ErrCode_ReqCanceled {
+			d.completeTx(tx.TID, err)
+			return nil
+		}
+		return err
+	}
+
+	// The merge worker releases the hold once the tx is merged
+	select {
+	case ch.txsToMerge <- tx:
+	case <-ch.CtxStopping():
+		atomic.AddInt32(&ch.txsPending, -1)
+		d.Warnf("chSess stopped; dropping Tx %v", TID(tx.TID).SuffixStr())
+		d.completeTx(tx.TID, ErrCode_ReqCanceled.ErrWithMsg("channel session stopped"))
+	}
+	return nil
+}
+
+// holdChSess returns the chSess for the given channel (issuing its LID and mounting it as needed), counting a pending tx against it so that it isn't stopped as idle.
+// The caller releases the hold by decrementing txsPending.
+func (d *domain) holdChSess(chID string) (*chSess, error) {
+	for {
+		ch, err := d.getChSess(chID, true)
+		if err != nil {
+			return nil, err
+		}
+
+		// Count the tx as pending while the chSess can't be stopped as idle (see stopChSessIfIdle)
+		d.chSessMu.RLock()
+		isMounted := d.chSess[ch.lid] == ch
+		if isMounted {
+			atomic.AddInt32(&ch.txsPending, 1)
+		}
+		d.chSessMu.RUnlock()
+
+		if isMounted {
+			return ch, nil
+		}
+	}
+}
+
 func (d *domain) stopChSessIfIdle(ch *chSess) bool {
 	d.chSessMu.Lock()
 	defer d.chSessMu.Unlock()
 
 	didStop := false
 
-	if d.chSess[ch.ChID] == ch {
+	if d.chSess[ch.lid] == ch {
 
-		// With the domain's ch session mutex locked, we can reliably call CtxChildCount
-		if ch.CtxChildCount() == 0 {
+		// With the domain's ch session mutex locked, we can reliably call CtxChildCount (and read txsPending)
+		if ch.CtxChildCount() == 0 && atomic.LoadInt32(&ch.txsPending) == 0 {
 			didStop = ch.CtxStop("idle chSess auto stop", nil)
-			delete(d.chSess, ch.ChID)
+			delete(d.chSess, ch.lid)
 		}
 	}
 
 	return didStop
 }
 
-// // getRootKeyForChURI returns the root keypath for a given channel ID.
-// func (d *domain) getRootKeyForChURI(uri *ChStateURI, dst ChKey) (ChKey, error) {
-
-// 	if len(uri.DomainName) == 0 {
-// 		return nil, ErrCode_InvalidURI.ErrWithMsg("missing domain name")
-// 	}
-
-// 	if len(uri.ChID_TID) > 0 {
-// 		dst = append(dst[:0], uri.ChID_TID...)
-// 		return dst, nil
-// 	}
-
-// 	// FUTURE
-// 	// TODO: a domain db issue channel ID numbers and then has a separate ch ID/TID lookip where multiple ch ID names remap to a ChID # (a uint32).
-// 	// The *same* code can be reused to provide domain name alaiasing as the host level!
-// 	if len(uri.ChID) > 0 {
-// 		dst = append(dst, '/')
-// 		dst = append(dst, uri.ChID...)
-// 		dst = append(dst, '/')
-// 		return dst, nil
-// 	}
+// txCompletion is the TxCompletion returned by domain.SubmitTx().
+type txCompletion struct {
+	done chan struct{}
+	err  error
+}
 
-// 	return nil, ErrCode_InvalidURI.ErrWithMsg("no channel ID or TID given")
-// }
+// Done -- see interface TxCompletion
+func (tc *txCompletion) Done() <-chan struct{} {
+	return tc.done
+}
 
-// SubmitTx -- see Domain interface
-func (d *domain) SubmitTx(tx *Tx) error {
-	d.txsToMerge <- tx
+// Err -- see interface TxCompletion
+func (tc *txCompletion) Err() error {
+	<-tc.done
+	return tc.err
+}
 
-	return nil
+// pendingTx is a tx in this domain's pipeline that has yet to be merged or rejected.
+type pendingTx struct {
+	completions []*txCompletion
+	isLocal     bool // set if the tx was submitted via SubmitTx (rather than received from a vault)
 }
 
-// OpenChSub -- see interface Domain
-func (d *domain) OpenChSub(chReq *ChReq) (ChSub, error) {
-	ch, err := d.getChSess(chReq.ChStateURI.ChID, true)
-	if err != nil {
-		return nil, err
+func (pending *pendingTx) complete(err error) {
+	for _, tc := range pending.completions {
+		tc.err = err
+		close(tc.done)
 	}
-
-	return ch.OpenChSub(chReq)
 }
 
-func (ch *chSess) mergeTx(tx *Tx) error {
-	var err error
-	{
-		dbTx := ch.domain.stateDB.NewTransaction(true)
+// completeTx completes each pending txCompletion for the given TID.
+func (d *domain) completeTx(tid TID, err error) {
+	d.pendingTxsMu.Lock()
+	pending := d.pendingTxs[string(tid)]
+	delete(d.pendingTxs, string(tid))
+	d.pendingTxsMu.Unlock()
 
-		scrap := ch.domain.writeScrap
+	if pending != nil {
+		pending.complete(err)
+	}
+}
 
-		for idx, entry := range tx.TxOp.Entries {
+// isLocalTx returns true if the given pending tx was submitted via SubmitTx.
+func (d *domain) isLocalTx(tid TID) bool {
+	d.pendingTxsMu.Lock()
+	pending := d.pendingTxs[string(tid)]
+	d.pendingTxsMu.Unlock()
 
-			ch.Debugf("%d/%d writing: '%s'", idx+1, len(tx.TxOp.Entries), entry.Keypath)
+	return pending != nil && pending.isLocal
+}
 
-			origKeypath := entry.Keypath
-			origReqID := entry.ReqID
+// hasPendingTxs returns true if any tx submitted to this domain has yet to be merged or rejected.
+func (d *domain) hasPendingTxs() bool {
+	d.pendingTxsMu.Lock()
+	defer d.pendingTxsMu.Unlock()
 
-			{
-				dbEntry := &badger.Entry{
-					Key: append(append(scrap[:0], ch.keyPrefix...), entry.Keypath...),
-				}
-				scrap = scrap[len(dbEntry.Key):]
-
-				entry.ReqID = 0
-				entry.Keypath = ""
-
-				// Only retain a scrap buffer that isn't wastefully large
-				entrySz := entry.Size()
-				entryBuf := scrap
-				entryUsesScrap := true
-				if entrySz > cap(entryBuf) {
-					entryBuf = make([]byte, entrySz+1000)
-					if entrySz < 500000 {
-						ch.domain.writeScrap = entryBuf
-						scrap = entryBuf
-					} else {
-						entryUsesScrap = false
-					}
-				}
-				entrySz, err = entry.MarshalToSizedBuffer(entryBuf[:entrySz])
-				dbEntry.Value = entryBuf[:entrySz]
-				if entryUsesScrap {
-					scrap = scrap[entrySz:]
-				}
+	return len(d.pendingTxs) > 0
+}
 
-				ch.Infof(2, "SET: %v", string(dbEntry.Key))
-				err = dbTx.SetEntry(dbEntry)
-			}
+// completeAllTxs completes every pending txCompletion with the given error.
+func (d *domain) completeAllTxs(err error) {
+	d.pendingTxsMu.Lock()
+	pendingTxs := d.pendingTxs
+	d.pendingTxs = make(map[string]*pendingTx)
+	d.pendingTxsMu.Unlock()
 
-			// Now that we've serialized the entry, restore meta entry fields (they aren't data that is stored)
-			entry.Keypath = origKeypath
-			entry.ReqID = origReqID
-		}
+	for _, pending := range pendingTxs {
+		pending.complete(err)
+	}
+}
 
-		// TODO: handle errs
-		err = dbTx.Commit()
+// SubmitTx -- see Domain interface
+//
+// Locally authored txns are verified and decoded the same as txns arriving from elsewhere.
+// In addition, their entry preconditions are checked (see checkPreconditions), and they are only published to vaults once merged.
+func (d *domain) SubmitTx(tx *Tx) (TxCompletion, error) {
+	if tx.RawTx == nil {
+		return nil, ErrCode_NothingToCommit.ErrWithMsg("missing RawTx (tx not signed)")
 	}
 
-	if err != nil {
-		return err
+	tc := &txCompletion{
+		done: make(chan struct{}),
 	}
+	d.submitRawTx(tx.RawTx, tc, true)
 
-	return err
+	return tc, nil
 }
 
-func (ch *chSess) broadcastToSubs(tx *Tx) {
-	ch.subsMu.RLock()
-	{
-		for _, sub := range ch.subs {
-			sub.txInbox <- tx
+// submitRawTx inserts the given RawTx into this domain's pipeline to be verified, decoded, and merged.
+// The tx is pending (see GetTxStatus) until it is merged or rejected, at which point the given txCompletion (if any) is completed.
+// isLocal is set if the tx was authored on this host (see SubmitTx).
+func (d *domain) submitRawTx(rawTx *RawTx, tc *txCompletion, isLocal bool) {
+	d.txsToDecodeMu.RLock()
+	defer d.txsToDecodeMu.RUnlock()
+
+	// A domain can be stopped while a caller still holds it (see host.RenameDomain)
+	if d.txsToDecode == nil {
+		if tc != nil {
+			tc.err = ErrCode_ReqCanceled.ErrWithMsg("domain stopped")
+			close(tc.done)
 		}
+		return
 	}
-	ch.subsMu.RUnlock()
-}
-
-func (ch *chSess) ctxStartup() error {
 
-	if len(ch.domain.domainName) == 0 {
-		return ErrCode_InvalidURI.ErrWithMsg("missing domain name")
+	// Register before submitting so that the outcome can't be missed
+	d.pendingTxsMu.Lock()
+	pending := d.pendingTxs[string(rawTx.TID)]
+	if pending == nil {
+		pending = &pendingTx{}
+		d.pendingTxs[string(rawTx.TID)] = pending
 	}
-
-	if len(ch.ChID) == 0 {
-		return ErrCode_InvalidURI.ErrWithMsg("missing channel ID")
+	if tc != nil {
+		pending.completions = append(pending.completions, tc)
 	}
+	if isLocal {
+		pending.isLocal = true
+	}
+	d.pendingTxsMu.Unlock()
 
-	// FUTURE
-	// TODO: a domain db issue channel ID numbers and then has a separate ch ID/TID lookip where multiple ch ID names remap to a ChID # (a uint32).
-	// The *same* code can be reused to provide domain name alaiasing as the host level!
-	// seq, err := db.GetSequence(key, 1000)
-	// defer seq.Release()
-	// for {
-	// num, err := seq.Next()
-	// }
-	keypath := fmt.Sprintf("%s/%s/", ch.domain.domainName, ch.ChID)
-	ch.keyPrefix = append(ch.keyPrefixBuf[:0], keypath...)
-	ch.SetLogLabelf("chSess …%v", ch.ChID[len(ch.ChID)-5:])
-
-	ch.Info(2, "starting ", keypath)
-
-	return nil
+	d.txsToDecode <- rawTx
 }
 
-func (ch *chSess) onChSubStopping(child ctx.Ctx) {
+// maxTxsAwaitingGenesis is the number of txns a domain holds while awaiting channel geneses before it rejects any more.
+const maxTxsAwaitingGenesis = 1024
 
-	// When closing the last ch subscription, set up an autocheck that spins down this ch session (if it's still idle)
-	if ch.CtxChildCount() <= 1 {
-		ch.CtxGo(func() {
-			ticker := time.NewTicker(ch.domain.chAutoStopDelay)
-			defer ticker.Stop()
+// awaitGenesis holds the given tx (received from elsewhere) until the genesis of each channel it writes to has been merged,
+// returning false if too many txns are already awaiting a genesis (in which case the tx should be rejected).
+//
+// The tx remains pending meanwhile (see GetTxStatus), so a vault doesn't acknowledge it and would send it again should this domain stop.
+func (d *domain) awaitGenesis(tx *Tx) bool {
+	d.awaitingMu.Lock()
+	defer d.awaitingMu.Unlock()
 
-			select {
-			case <-ticker.C:
-				ch.domain.stopChSessIfIdle(ch)
-			case <-ch.CtxStopping():
-				break
-			}
-		})
+	if len(d.awaitingGenesis) >= maxTxsAwaitingGenesis {
+		return false
 	}
+	d.Infof(1, "Tx %v awaiting channel genesis", TID(tx.TID).SuffixStr())
+	d.awaitingGenesis = append(d.awaitingGenesis, tx)
+	return true
 }
 
-func (ch *chSess) ctxOnStopping() {
-	if N := len(ch.subs); N > 0 {
-		ch.Warnf("chSess being stopped with %d active subs", N)
+// releaseTxsAwaitingGenesis resubmits each tx awaiting the genesis of the given channel (now merged).
+// A tx that writes to another channel yet to be created awaits that channel's genesis in turn.
+func (d *domain) releaseTxsAwaitingGenesis(chID string) {
+	var released []*Tx
+
+	d.awaitingMu.Lock()
+	N := 0
+	for _, tx := range d.awaitingGenesis {
+		if tx.TxOp.WritesToCh(chID) {
+			released = append(released, tx)
+		} else {
+			d.awaitingGenesis[N] = tx
+			N++
+		}
+	}
+	for i := N; i < len(d.awaitingGenesis); i++ {
+		d.awaitingGenesis[i] = nil
+	}
+	d.awaitingGenesis = d.awaitingGenesis[:N]
+	d.awaitingMu.Unlock()
+
+	// Since this is called from a merge worker, resubmitting mustn't block on the pipeline feeding it
+	if len(released) > 0 {
+		go func() {
+			for _, tx := range released {
+				d.submitRawTx(tx.RawTx, nil, false)
+			}
+		}()
 	}
 }
 
-// OpenChSub -- see interface Domain
-func (ch *chSess) OpenChSub(chReq *ChReq) (ChSub, error) {
+// rejectTx quarantines the given RawTx and completes any txCompletion waiting on it.
+func (d *domain) rejectTx(rawTx *RawTx, reason error) {
+	d.Warnf("rejecting Tx %v: %v", TID(rawTx.TID).SuffixStr(), reason)
 
-	sub := &chSub{
-		chSess:          ch,
-		chReq:           chReq,
-		nodeOutbox:      make(chan *Node),
-		clientSuspended: true,
+	if err := d.quarantineTx(rawTx, reason); err != nil {
+		d.Errorf("failed to quarantine Tx %v: %v", TID(rawTx.TID).SuffixStr(), err)
 	}
 
-	// Start the subscription as a child ctx of each ch session
-	err := sub.CtxStart(
-		sub.ctxStartup,
-		nil,
-		nil,
-		sub.ctxStopping,
-	)
-	if err != nil {
-		return nil, err
-	}
-	ch.CtxAddChild(sub, nil)
+	d.completeTx(rawTx.TID, reason)
+}
 
-	if sub.chReq.GetOp.MaintainSync {
-		sub.txInbox = make(chan *Tx, 4)
-		ch.registerSub(sub)
+// quarantineTx stores the given rejected RawTx in this domain's quarantine keyspace, keyed by TID, so it can be inspected later.
+func (d *domain) quarantineTx(rawTx *RawTx, reason error) error {
+	qtx := &QuarantinedTx{
+		RawTx:           rawTx,
+		Err:             toReqErr(reason),
+		TimeQuarantined: int64(device.TimeNowFS()),
 	}
 
-	return sub, nil
-}
+	key := make([]byte, 0, len(d.keyPrefix)+len(quarantineKeypath)+len(rawTx.TID))
+	key = append(append(append(key, d.keyPrefix...), quarantineKeypath...), rawTx.TID...)
 
-func (ch *chSess) registerSub(sub *chSub) {
-	ch.subsMu.Lock()
-	ch.subs = append(ch.subs, sub)
-	ch.subsMu.Unlock()
+	return d.stateDB.Update(func(dbTx *badger.Txn) error {
+		err := dbTx.Set(key, bufs.SmartMarshal(qtx, nil))
+		if err == nil && len(rawTx.TID) == TIDSz {
+			err = d.setTxStatus(dbTx, rawTx.TID, TxState_Rejected, reason)
+		}
+		return err
+	})
 }
 
-func (ch *chSess) unregisterSub(remove *chSub) {
-	ch.subsMu.Lock()
-	N := len(ch.subs)
-	for i := 0; i < N; i++ {
-		if ch.subs[i] == remove {
-			N--
-			ch.subs[i] = ch.subs[N]
-			ch.subs[N] = nil
-			ch.subs = ch.subs[:N]
-			break
-		}
+// OpenChSub -- see interface Domain
+func (d *domain) OpenChSub(chReq *ChReq, reader MemberSession) (ChSub, error) {
+	ch, err := d.getChSess(chReq.ChStateURI.ChID, false)
+	if err != nil {
+		return nil, err
 	}
-	ch.subsMu.Unlock()
+
+	return ch.OpenChSub(chReq, reader)
 }
 
-func (sub *chSub) Outbox() <-chan *Node {
-	return sub.nodeOutbox
+// mergedTxs are the txns merged into a channel in a single db commit, along with the db version they were committed at.
+// Each Tx contains only the entries that were applied to the channel (and txns with no entries applied are omitted).
+type mergedTxs struct {
+	ch      *chSess
+	txs     []*Tx
+	version uint64
 }
 
-func (sub *chSub) Close() {
-	sub.CtxStop("ch sub cancelled", nil)
+// chTarget is a channel that a Tx writes to, along with the entries it writes there.
+type chTarget struct {
+	ch      *chSess
+	uri     *ChStateURI
+	entries []*Node
 }
 
-func (sub *chSub) ctxStartup() error {
-	var err error
+// commitConflictRetries is the number of times a commit is retried after conflicting with a concurrent commit to the same keys.
+// Since each channel has its own merge worker, this only arises when a multi-channel tx is merged alongside txns of its other channels.
+const commitConflictRetries = 8
 
-	sub.chReq.GetOp.Keypath, err = NormalizeKeypath(sub.chReq.GetOp.Keypath)
-	if err != nil {
-		return err
+// mergeTxs merges the given txns (each for this channel) in a single db commit.
+// If the commit fails, each tx is merged on its own so that a rejected tx doesn't hold back the others.
+//
+// Merging is idempotent by TID: a tx that has already been merged is completed but otherwise ignored (and is not passed on to feeds).
+func (ch *chSess) mergeTxs(txs []*Tx) {
+
+	// Hold every other channel these txns write to so that they stay mounted until subscribers have been notified
+	others, err := ch.holdOtherChs(txs)
+	defer func() {
+		for _, other := range others {
+			atomic.AddInt32(&other.txsPending, -1)
+		}
+	}()
+
+	var newTxs []*Tx
+	if err == nil {
+		newTxs, err = ch.commitTxs(txs, others)
+		for retries := 0; err == badger.ErrConflict && retries < commitConflictRetries; retries++ {
+			newTxs, err = ch.commitTxs(txs, others)
+		}
+		if err == badger.ErrConflict {
+			err = ErrCode_CommitFailed.Wrap(err)
+		}
+	}
+	if err != nil && toReqErr(err).Code == ErrCode_ReqCanceled {
+		for _, tx := range txs {
+			ch.domain.completeTx(tx.TID, err)
+		}
+		return
 	}
+	if err != nil {
+		if len(txs) > 1 {
+			for i := range txs {
+				ch.mergeTxs(txs[i : i+1])
+			}
+			return
+		}
 
-	chDesc := sub.chSess.GetLogLabel()
-	//sub.SetLogLabelf("%s/%s sub%03x", sub.chSess.GetLogLabel(), sub.chReq.GetOp.Keypath, sub.chReq.ReqID)
-	sub.SetLogLabelf("sub%03d …%s/%s", sub.chReq.ReqID, chDesc[len(chDesc)-5:], sub.chReq.GetOp.Keypath)
+		// A tx that arrived ahead of the genesis of a channel it writes to is merged once that genesis is
+		if toReqErr(err).Code == ErrCode_ChNotFound && ch.domain.awaitGenesis(txs[0]) {
+			return
+		}
+		ch.domain.rejectTx(txs[0].RawTx, err)
+		return
+	}
 
-	sub.CtxGo(func() {
+	// Locally authored txns are published only once merged, so that a tx rejected here is never merged elsewhere
+	for _, tx := range newTxs {
+		if ch.domain.isLocalTx(tx.TID) {
+			ch.domain.host.vaultMgr.publishTx(ch.domain.domainName, tx.RawTx)
+		}
+	}
+	for _, tx := range txs {
+		ch.domain.completeTx(tx.TID, nil)
+	}
+	for _, tx := range newTxs {
+		if tx.TxOp.ChannelGenesis {
+			ch.domain.releaseTxsAwaitingGenesis(tx.TxOp.ChStateURI.ChID)
+		}
+	}
+}
 
-		sub.sendStateToClient()
+// holdOtherChs returns the chSess of each channel (other than this one) that the given txns also write to, mounting each as needed.
+// Each returned chSess is held (see domain.holdChSess) and must be released by the caller.
+func (ch *chSess) holdOtherChs(txs []*Tx) (map[string]*chSess, error) {
+	var others map[string]*chSess
 
-		for {
-			if sub.clientSuspended {
-				sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_ChSyncResume, nil)
-				sub.clientSuspended = false
+	for _, tx := range txs {
+		for _, chEntries := range tx.TxOp.ChEntries {
+			if others[chEntries.ChID] != nil {
+				continue
 			}
-
-			// If we're only sending state, we're done.
-			if sub.txInbox == nil {
-				break
+			other, err := ch.domain.holdChSess(chEntries.ChID)
+			if err != nil {
+				return others, err
+			}
+			if others == nil {
+				others = make(map[string]*chSess)
+			}
+			others[chEntries.ChID] = other
+		}
+	}
+
+	return others, nil
+}
+
+// commitTxs writes the given txns in a single db commit and then delivers the txns merged into each channel written to (see deliverMerged),
+// returning the given txns that were newly merged (see mergeTx).
+//
+// badger.ErrConflict is returned as is so that the caller can retry the commit.
+func (ch *chSess) commitTxs(txs []*Tx, others map[string]*chSess) ([]*Tx, error) {
+	dbTx := ch.domain.stateDB.NewTransaction(true)
+	defer dbTx.Discard()
+
+	// Each tx's entries are marshalled into scrap that must remain untouched until the commit
+	ch.scrap = ch.writeScrap
+	ch.dirChanges = ch.dirChanges[:0]
+
+	merged := []*mergedTxs{
+		{ch: ch},
+	}
+
+	var newTxs []*Tx
+	for _, tx := range txs {
+		applied, isNew, err := ch.mergeTx(dbTx, tx, others)
+		if err != nil {
+			return nil, err
+		}
+		if isNew {
+			newTxs = append(newTxs, tx)
+		}
+
+		for _, target := range applied {
+			var chMerged *mergedTxs
+			for _, m := range merged {
+				if m.ch == target.ch {
+					chMerged = m
+					break
+				}
+			}
+			if chMerged == nil {
+				chMerged = &mergedTxs{ch: target.ch}
+				merged = append(merged, chMerged)
+			}
+
+			// Only pass along a copy of the tx if it doesn't exactly match what was applied
+			appliedTx := tx
+			if target.ch != ch || len(tx.TxOp.ChEntries) > 0 || len(target.entries) != len(tx.TxOp.Entries) {
+				appliedTx = &Tx{
+					TID:    tx.TID,
+					RawTx:  tx.RawTx,
+					Signer: tx.Signer,
+					TxOp: &TxOp{
+						ChStateURI: target.uri,
+						Entries:    target.entries,
+					},
+				}
+			}
+			chMerged.txs = append(chMerged.txs, appliedTx)
+		}
+	}
+
+	// Other channels' workers also commit to (and deliver merged txns for) the channels written here, so commits are sent to the db
+	// while holding commitMu and are then delivered in that same order (see finishCommit), which is commit version order.
+	// Each worker waits on its own commit without holding commitMu, so channels are committed (and synced) in parallel.
+	d := ch.domain
+	pc := &pendingCommit{
+		merged:     merged,
+		newTxs:     newTxs,
+		dirChanges: append([]*ChInfo(nil), ch.dirChanges...),
+		committed:  make(chan struct{}),
+		delivered:  make(chan struct{}),
+	}
+
+	// Append each newly merged tx to the domain's merge log (see txFeed).
+	// A commit that fails leaves a gap in the merge seq, which a txFeed simply skips over.
+	d.commitMu.Lock()
+	pc.firstSeq = d.mergeSeq + 1
+	for i, tx := range newTxs {
+		if err := dbTx.Set(d.mergeLogKey(pc.firstSeq+uint64(i)), tx.TID); err != nil {
+			d.commitMu.Unlock()
+			return nil, ErrCode_CommitFailed.Wrap(err)
+		}
+	}
+	d.mergeSeq += uint64(len(newTxs))
+	d.commits = append(d.commits, pc)
+	dbTx.CommitWith(func(err error) {
+		pc.err = err
+		close(pc.committed)
+	})
+	d.commitMu.Unlock()
+
+	<-pc.committed
+	err := pc.err
+
+	// The commit version orders these txns relative to the snapshot each chSub sends (see chSub.snapshotVersion)
+	var version uint64
+	if err == nil && len(newTxs) > 0 {
+		version, err = d.readVersion(d.txLogKey(newTxs[0].TID))
+	}
+
+	N := 0
+	for _, chMerged := range merged {
+		if len(chMerged.txs) > 0 {
+			chMerged.version = version
+			merged[N] = chMerged
+			N++
+		}
+	}
+	pc.merged = merged[:N]
+	d.finishCommit(pc, err)
+	<-pc.delivered
+
+	if err == badger.ErrConflict {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ErrCode_CommitFailed.Wrap(err)
+	}
+	return newTxs, nil
+}
+
+// pendingCommit is a merge commit sent to the db that has yet to be delivered to subs and feeds (see commitTxs).
+type pendingCommit struct {
+	merged     []*mergedTxs
+	newTxs     []*Tx
+	firstSeq   uint64 // merge seq of newTxs[0]
+	dirChanges []*ChInfo
+	err        error
+	ready      bool          // set once the commit has completed (guarded by commitMu)
+	committed  chan struct{} // closed once the db commit completes
+	delivered  chan struct{} // closed once delivered (or discarded, if the commit failed)
+}
+
+// finishCommit marks the given commit as complete (with the given error) and then delivers each complete commit at the head of
+// the domain's pending commits, in the order they were sent to the db (see deliverMerged).
+func (d *domain) finishCommit(pc *pendingCommit, err error) {
+	d.commitMu.Lock()
+	defer d.commitMu.Unlock()
+
+	pc.err = err
+	pc.ready = true
+
+	for len(d.commits) > 0 && d.commits[0].ready {
+		next := d.commits[0]
+		d.commits[0] = nil
+		d.commits = d.commits[1:]
+		if next.err == nil {
+			d.deliverMerged(next)
+		}
+		close(next.delivered)
+	}
+}
+
+// deliverMerged passes the txns of the given commit to the subs of each channel written to, to domain subs, to channel directory subs, and to tx feeds.
+// None of these block, so this is called while holding commitMu (see finishCommit).
+func (d *domain) deliverMerged(pc *pendingCommit) {
+	for _, chMerged := range pc.merged {
+		chMerged.ch.broadcastToSubs(chMerged)
+		d.broadcastToDomainSubs(chMerged)
+	}
+	if len(pc.dirChanges) > 0 {
+		d.broadcastChDirChanges(pc.dirChanges)
+	}
+	for i, tx := range pc.newTxs {
+		d.broadcastToFeeds(tx, pc.firstSeq+uint64(i))
+	}
+}
+
+// mergeTx writes the entries of the given Tx (within the given db txn), returning the entries applied to each channel written to.
+//
+// A Tx writes its Entries to this channel and each of its ChEntries to the given channel (see holdOtherChs), all or nothing.
+// If the Tx is already in the tx log, it has already been merged, so nothing is written and isNew is false.
+func (ch *chSess) mergeTx(dbTx *badger.Txn, tx *Tx, others map[string]*chSess) (applied []chTarget, isNew bool, err error) {
+	_, err = dbTx.Get(ch.domain.txLogKey(tx.TID))
+	if err == nil {
+		return nil, false, nil
+	}
+	if err != badger.ErrKeyNotFound {
+		return nil, false, ErrCode_CommitFailed.Wrap(err)
+	}
+
+	targets := make([]chTarget, 0, 1+len(tx.TxOp.ChEntries))
+	targets = append(targets, chTarget{
+		ch:      ch,
+		uri:     tx.TxOp.ChStateURI,
+		entries: tx.TxOp.Entries,
+	})
+	for _, chEntries := range tx.TxOp.ChEntries {
+		targets = append(targets, chTarget{
+			ch: others[chEntries.ChID],
+			uri: &ChStateURI{
+				DomainName: ch.domain.domainName,
+				ChID:       chEntries.ChID,
+				ChID_TID:   chEntries.ChID_TID,
+			},
+			entries: chEntries.Entries,
+		})
+	}
+
+	// Nothing is written unless every channel written to exists (other than one created by the tx), the signer has the rights to write
+	// every entry, and (for a locally authored tx) every entry precondition holds.
+	isLocal := ch.domain.isLocalTx(tx.TID)
+	for i, target := range targets {
+		var err error
+		if isLocal && i > 0 || !isLocal && (i > 0 || tx.TxOp.ChannelGenesis == false) {
+			err = ch.domain.checkChExists(dbTx, target.uri.ChID, isLocal)
+		}
+		if err == nil {
+			err = target.ch.checkAccess(dbTx, tx, target.entries, i == 0 && tx.TxOp.ChannelGenesis)
+		}
+		if err == nil && isLocal {
+			err = target.ch.checkPreconditions(dbTx, target.entries)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	for i, target := range targets {
+		entries, err := ch.writeEntries(dbTx, target.ch, tx.TID, target.entries)
+		if err == nil {
+			err = dbTx.Set(ch.domain.chTxLogKey(target.ch.lid, tx.TID), nil)
+		}
+
+		// Keep the domain's channel directory current with each channel created or renamed
+		var info *ChInfo
+		if err == nil {
+			info, err = ch.domain.updateChDir(dbTx, tx, target.ch, target.uri, i == 0 && tx.TxOp.ChannelGenesis, entries)
+		}
+		if err != nil {
+			return nil, false, ErrCode_CommitFailed.Wrap(err)
+		}
+		if info != nil {
+			ch.dirChanges = append(ch.dirChanges, info)
+		}
+		if len(entries) > 0 {
+			target.entries = entries
+			applied = append(applied, target)
+		}
+	}
+
+	// Log the signed tx (in the same commit) so it can be served to other vaults and to clients catching up on its channels
+	err = dbTx.Set(ch.domain.txLogKey(tx.TID), tx.RawTx.Bytes)
+	if err == nil {
+		err = ch.domain.setTxStatus(dbTx, tx.TID, TxState_Merged, nil)
+	}
+	if err != nil {
+		return nil, false, ErrCode_CommitFailed.Wrap(err)
+	}
+
+	return applied, true, nil
+}
+
+// writeEntries writes the given entries of the given Tx to the given channel (within the given db txn), returning the entries that were applied.
+// Entries are marshalled into this chSess's scrap, so the target channel can be one merged by another worker.
+//
+// Entries are resolved by last-writer-wins: an entry is dropped unless its revStamp is greater than that of the node already stored at its keypath.
+// This ensures replicas converge regardless of the order in which they merge txns.
+//
+// Removed nodes are replaced with a tombstone (see marshalTombstone) rather than deleted so that an older revision arriving late is still dropped.
+// An entry is also dropped if an ancestor keypath holds a newer NodeRemoveAll tombstone.
+func (ch *chSess) writeEntries(dbTx *badger.Txn, target *chSess, tid TID, entries []*Node) ([]*Node, error) {
+	var (
+		rev     revStamp
+		applied []*Node
+	)
+
+	for idx, entry := range entries {
+
+		target.Debugf("%d/%d writing: '%s'", idx+1, len(entries), entry.Keypath)
+
+		// Start a fresh scrap buffer once the current one is used up (a ChKey is one byte longer than its keypath)
+		if keySz := len(target.keyPrefix) + len(entry.Keypath) + 1; keySz > len(ch.scrap) {
+			ch.writeScrap = make([]byte, keySz+32000)
+			ch.scrap = ch.writeScrap
+		}
+
+		dbEntry := &badger.Entry{
+			Key: AppendChKey(append(ch.scrap[:0], target.keyPrefix...), entry.Keypath),
+		}
+		ch.scrap = ch.scrap[len(dbEntry.Key):]
+
+		rev.set(entry.RevID, tid)
+		isNewer, err := target.isNewerThanAncestors(dbTx, entry.Keypath, &rev)
+		if err != nil {
+			return nil, err
+		}
+		if isNewer == false {
+			target.Infof(2, "DROP: %v (removed by ancestor)", entry.Keypath)
+			continue
+		}
+
+		if entry.Op == NodeOp_NodeUpdate {
+			origKeypath := entry.Keypath
+			origReqID := entry.ReqID
+			origPrecondition := entry.Precondition
+			origPreconditionRevID := entry.PreconditionRevID
+			origChID := entry.ChID
+
+			entry.ReqID = 0
+			entry.Keypath = ""
+			entry.Precondition = Precondition_None
+			entry.PreconditionRevID = 0
+			entry.ChID = ""
+
+			// Only retain a scrap buffer that isn't wastefully large
+			entrySz := revStampSz + entry.Size()
+			entryBuf := ch.scrap
+			entryUsesScrap := true
+			if entrySz > cap(entryBuf) {
+				entryBuf = make([]byte, entrySz+1000)
+				if entrySz < 500000 {
+					ch.writeScrap = entryBuf
+					ch.scrap = entryBuf
+				} else {
+					entryUsesScrap = false
+				}
+			}
+			copy(entryBuf, rev[:])
+			entrySz, err = entry.MarshalToSizedBuffer(entryBuf[revStampSz:entrySz])
+			entrySz += revStampSz
+			dbEntry.Value = entryBuf[:entrySz]
+			if entryUsesScrap {
+				ch.scrap = ch.scrap[entrySz:]
+			}
+
+			// Now that we've serialized the entry, restore meta entry fields (they aren't data that is stored)
+			entry.Keypath = origKeypath
+			entry.ReqID = origReqID
+			entry.Precondition = origPrecondition
+			entry.PreconditionRevID = origPreconditionRevID
+			entry.ChID = origChID
+		} else {
+			dbEntry.Value = marshalTombstone(entry.Op, &rev)
+			dbEntry.UserMeta = metaTombstone
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Every revision is retained in the channel's history, even one superseded by the time it arrives
+		err = dbTx.Set(target.histKey(dbEntry.Key[len(target.keyPrefix):], &rev), dbEntry.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		isNewer, err = isNewerRev(dbTx, dbEntry.Key, &rev)
+		if err != nil {
+			return nil, err
+		}
+		if isNewer == false {
+			target.Infof(2, "DROP: %v (stale revision)", entry.Keypath)
+			continue
+		}
+
+		target.Infof(2, "SET: %v %v", entry.Op, entry.Keypath)
+		err = dbTx.SetEntry(dbEntry)
+		if err == nil && entry.Op == NodeOp_NodeRemoveAll {
+			err = target.removeDescendants(dbTx, dbEntry.Key, &rev)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		applied = append(applied, entry)
+	}
+
+	return applied, nil
+}
+
+// readVersion returns the db version at which the given key was last written.
+func (d *domain) readVersion(key []byte) (uint64, error) {
+	var version uint64
+
+	err := d.stateDB.View(func(dbTx *badger.Txn) error {
+		item, err := dbTx.Get(key)
+		if err == nil {
+			version = item.Version()
+		}
+		return err
+	})
+
+	return version, err
+}
+
+// marshalTombstone returns a stored tombstone for the given removal op: a node that retains only the op and its revision.
+func marshalTombstone(op NodeOp, rev *revStamp) []byte {
+	tombstone := &Node{
+		Op:    op,
+		RevID: rev.RevID(),
+	}
+	return marshalStoredNode(rev, tombstone)
+}
+
+// setNode writes the given stored node value (and UserMeta) to the given key and to the channel's history.
+func (ch *chSess) setNode(dbTx *badger.Txn, key []byte, val []byte, meta byte, rev *revStamp) error {
+	err := dbTx.SetEntry(badger.NewEntry(key, val).WithMeta(meta))
+	if err == nil {
+		err = dbTx.Set(ch.histKey(key[len(ch.keyPrefix):], rev), val)
+	}
+	return err
+}
+
+// removeDescendants writes a tombstone over each node under the given key whose revision precedes the given revStamp.
+func (ch *chSess) removeDescendants(dbTx *badger.Txn, key []byte, rev *revStamp) error {
+	var keys [][]byte
+
+	// Collect the keys to remove before writing so the iterator isn't reading the keys being written
+	{
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = key
+		itr := dbTx.NewIterator(opts)
+
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			item := itr.Item()
+
+			// Every other key led by the given key is a descendant
+			if len(item.Key()) == len(key) {
+				continue
+			}
+			err := item.Value(func(val []byte) error {
+				if len(val) < revStampSz || bytes.Compare(rev[:], val[:revStampSz]) > 0 {
+					keys = append(keys, item.KeyCopy(nil))
+				}
+				return nil
+			})
+			if err != nil {
+				itr.Close()
+				return err
+			}
+		}
+		itr.Close()
+	}
+
+	tombstone := marshalTombstone(NodeOp_NodeRemove, rev)
+	for _, descKey := range keys {
+		ch.Infof(2, "REMOVE: %v", ChKey(descKey[len(ch.keyPrefix):]))
+		err := ch.setNode(dbTx, descKey, tombstone, metaTombstone, rev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isNewerThanAncestors returns false if an ancestor of the given keypath holds a NodeRemoveAll tombstone whose revision is not less than the given revStamp.
+func (ch *chSess) isNewerThanAncestors(dbTx *badger.Txn, keypath string, rev *revStamp) (bool, error) {
+	key := append(make([]byte, 0, len(ch.keyPrefix)+len(keypath)+1), ch.keyPrefix...)
+
+	for i := 0; i < len(keypath); i++ {
+		if keypath[i] != '/' {
+			continue
+		}
+
+		// An ancestor's ChKey is as long as its keypath plus a separator, so it also marks where the next component starts
+		compStart := len(key) - len(ch.keyPrefix)
+		key = AppendChKey(key, keypath[compStart:i])
+
+		item, err := dbTx.Get(key)
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		isNewer := true
+		err = item.Value(func(val []byte) error {
+			if len(val) >= revStampSz && bytes.Compare(rev[:], val[:revStampSz]) <= 0 {
+				var ancestor Node
+				if err := unmarshalStoredNode(val, &ancestor); err != nil {
+					return err
+				}
+				isNewer = ancestor.Op != NodeOp_NodeRemoveAll
+			}
+			return nil
+		})
+		if err != nil || isNewer == false {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// checkPreconditions returns ErrCode_PreconditionFailed if the precondition of any of the given entries doesn't hold.
+//
+// Preconditions are evaluated against this channel's state (as seen within the given db txn) before any of a Tx's entries are written.
+// They are only checked on the host where a Tx is authored (see domain.SubmitTx), which publishes the Tx only once it is merged.
+// Replicas merge the Tx unconditionally: since they may merge concurrent txns in different orders, checking there would reject different txns on different replicas.
+func (ch *chSess) checkPreconditions(dbTx *badger.Txn, entries []*Node) error {
+	var key []byte
+
+	for _, entry := range entries {
+		if entry.Precondition == Precondition_None {
+			continue
+		}
+
+		var cur Node
+		exists := false
+
+		key = AppendChKey(append(key[:0], ch.keyPrefix...), entry.Keypath)
+		item, err := dbTx.Get(key)
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				return unmarshalStoredNode(val, &cur)
+			})
+
+			// A tombstone means the node was removed
+			exists = err == nil && cur.Op == NodeOp_NodeUpdate
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return ErrCode_CommitFailed.Wrap(err)
+		}
+
+		holds := false
+		switch entry.Precondition {
+		case Precondition_MustExist:
+			holds = exists
+		case Precondition_MustNotExist:
+			holds = !exists
+		case Precondition_RevIDMatches:
+			holds = exists && cur.RevID == entry.PreconditionRevID
+		}
+
+		if !holds {
+			return ErrCode_PreconditionFailed.ErrWithMsgf("precondition %v failed for '%s'", entry.Precondition, entry.Keypath)
+		}
+	}
+
+	return nil
+}
+
+// checkAccess returns an error if the verified signer of the given Tx lacks the rights needed to write each of the given entries to this channel.
+//
+// If isGenesis is set, this channel is being created by the Tx, so its signer is granted AllAccess in the new channel's ACL.
+// Like any other entry, the grant is resolved by last-writer-wins, so it never overwrites a later change to the creator's rights.
+// The genesis Tx itself is always written with AllAccess.
+func (ch *chSess) checkAccess(dbTx *badger.Txn, tx *Tx, entries []*Node, isGenesis bool) error {
+	if len(tx.Signer) == 0 {
+		return ErrCode_AccessDenied.ErrWithMsg("tx signer not verified")
+	}
+
+	aclKey := ch.domain.aclKeyFor(ch.lid, tx.Signer)
+
+	var rights ChRights
+	if isGenesis {
+		rights = AllAccess
+		grant := &Node{
+			Op:    NodeOp_NodeUpdate,
+			RevID: int64(TID(tx.TID).ExtractTimeFS()),
+			Int:   int64(rights),
+		}
+		var rev revStamp
+		rev.set(grant.RevID, tx.TID)
+		isNewer, err := isNewerRev(dbTx, aclKey, &rev)
+		if err == nil && isNewer {
+			err = ch.setNode(dbTx, aclKey, marshalStoredNode(&rev, grant), 0, &rev)
+		}
+		if err != nil {
+			return ErrCode_CommitFailed.Wrap(err)
+		}
+	} else {
+		var err error
+		rights, err = readRights(dbTx, aclKey)
+		if err != nil {
+			return ErrCode_CommitFailed.Wrap(err)
+		}
+	}
+
+	for _, entry := range entries {
+		required := WriteAccess
+		if IsACLKeypath(entry.Keypath) || entry.Keypath == ChNameKeypath {
+			required = AdminAccess
+		}
+		if (rights & required) != required {
+			return ErrCode_AccessDenied.ErrWithMsgf("signer %v lacks rights to write '%s'", bufs.BufDesc(tx.Signer), entry.Keypath)
+		}
+	}
+
+	return nil
+}
+
+// aclKeyFor returns the db key of the ACL entry for the given member pub key in the given channel (see chSess.keyPrefix).
+func (d *domain) aclKeyFor(chLID LID, pubKey []byte) []byte {
+	keypath := aclKeypathFor(pubKey)
+	key := make([]byte, 0, len(d.keyPrefix)+lidKeySz+len(keypath)+3)
+	key = append(appendLIDKey(append(append(key, d.keyPrefix...), '/'), chLID), '/')
+	return AppendChKey(key, keypath)
+}
+
+// aclKeypathFor returns the channel keypath of the ACL entry for the given member pub key.
+func aclKeypathFor(pubKey []byte) string {
+	return ACLKeypath + "/" + bufs.Base32Encoding.EncodeToString(pubKey)
+}
+
+// readRights returns the rights granted by the ACL entry stored at the given db key (or none if there is no entry).
+func readRights(dbTx *badger.Txn, aclKey []byte) (ChRights, error) {
+	var rights ChRights
+
+	item, err := dbTx.Get(aclKey)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			var grant Node
+			err := unmarshalStoredNode(val, &grant)
+			rights = ChRights(grant.Int)
+			return err
+		})
+	}
+	return rights, err
+}
+
+// checkReadAccess returns ErrCode_AccessDenied unless the member with the given pub key has ReadAccess to this channel.
+func (ch *chSess) checkReadAccess(reader []byte) error {
+	return ch.domain.checkReadAccess(ch.lid, ch.ChID, reader)
+}
+
+// checkReadAccess returns ErrCode_AccessDenied unless the member with the given pub key has ReadAccess to the given channel.
+func (d *domain) checkReadAccess(chLID LID, chID string, reader []byte) error {
+	if len(reader) == 0 {
+		return ErrCode_AccessDenied.ErrWithMsg("member access not expanded")
+	}
+
+	var rights ChRights
+	err := d.stateDB.View(func(dbTx *badger.Txn) error {
+		var err error
+		rights, err = readRights(dbTx, d.aclKeyFor(chLID, reader))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if (rights & ReadAccess) == 0 {
+		return ErrCode_AccessDenied.ErrWithMsgf("member %v lacks rights to read channel %v", bufs.BufDesc(reader), chID)
+	}
+	return nil
+}
+
+// readAccessRevoked is the stop reason of a sub or tx feed whose reader's ReadAccess was revoked while it maintained sync.
+const readAccessRevoked = "read access revoked"
+
+// readerKey returns the pub key identifying the given reader (or nil if access has not been expanded).
+func readerKey(reader MemberSession) []byte {
+	if reader == nil {
+		return nil
+	}
+	return reader.PubKey()
+}
+
+// isACLChangeFor returns true if the given merged txns change the ACL entry of the member with the given pub key.
+func isACLChangeFor(merged *mergedTxs, pubKey []byte) bool {
+	keypath := aclKeypathFor(pubKey)
+	for _, tx := range merged.txs {
+		for _, change := range tx.TxOp.Entries {
+			if change.Keypath == keypath {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// broadcastToSubs queues the given merged txns for each sub maintaining sync.
+// Since this is called from the domain's merge loop, it never blocks: a sub that has fallen behind is marked out of sync and later resyncs itself (see chSub.resync).
+func (ch *chSess) broadcastToSubs(merged *mergedTxs) {
+	ch.subsMu.RLock()
+	{
+		for _, sub := range ch.subs {
+			select {
+			case sub.txInbox <- merged:
+			default:
+				if atomic.CompareAndSwapInt32(&sub.outOfSync, 0, 1) {
+					sub.Warn("fell behind; dropping txns until resynced")
+				}
+			}
+		}
+	}
+	ch.subsMu.RUnlock()
+}
+
+func (ch *chSess) ctxStartup() error {
+
+	if len(ch.domain.domainName) == 0 {
+		return ErrCode_InvalidURI.ErrWithMsg("missing domain name")
+	}
+
+	if len(ch.ChID) == 0 {
+		return ErrCode_InvalidURI.ErrWithMsg("missing channel ID")
+	}
+
+	// A channel's keys are named by its LID rather than its (much longer) ChID
+	domainPrefix := ch.domain.keyPrefix
+	ch.keyPrefix = append(append(ch.keyPrefixBuf[:0], domainPrefix...), '/')
+	ch.keyPrefix = append(appendLIDKey(ch.keyPrefix, ch.lid), '/')
+	ch.histPrefix = append(append(make([]byte, 0, len(domainPrefix)+len(histKeypath)+lidKeySz+1), domainPrefix...), histKeypath...)
+	ch.histPrefix = append(appendLIDKey(ch.histPrefix, ch.lid), '/')
+	ch.SetLogLabelf("chSess …%v", ch.ChID[len(ch.ChID)-5:])
+
+	ch.Infof(2, "starting %s/%s (LID %d)", ch.domain.domainName, ch.ChID, ch.lid)
+
+	ch.CtxGo(ch.mergeWorker)
+
+	return nil
+}
+
+// mergeWorker merges the txns queued for this channel, batching txns that queue up into a single db commit.
+func (ch *chSess) mergeWorker() {
+	batch := make([]*Tx, 0, mergeBatchMaxTxs)
+
+	for running := true; running; {
+		select {
+		case tx := <-ch.txsToMerge:
+			batch = append(batch[:0], tx)
+			batchSz := len(tx.RawTx.Bytes)
+
+			for len(batch) < mergeBatchMaxTxs && batchSz < mergeBatchMaxSz {
+				select {
+				case tx = <-ch.txsToMerge:
+					batch = append(batch, tx)
+					batchSz += len(tx.RawTx.Bytes)
+					continue
+				default:
+				}
+				break
+			}
+
+			ch.mergeTxs(batch)
+			atomic.AddInt32(&ch.txsPending, -int32(len(batch)))
+
+		case <-ch.CtxStopping():
+			running = false
+		}
+	}
+
+	// Merge any txns that were queued before stopping
+	for {
+		select {
+		case tx := <-ch.txsToMerge:
+			ch.mergeTxs([]*Tx{tx})
+			atomic.AddInt32(&ch.txsPending, -1)
+		default:
+			return
+		}
+	}
+}
+
+func (ch *chSess) onChSubStopping(child ctx.Ctx) {
+
+	// When closing the last ch subscription, set up an autocheck that spins down this ch session (if it's still idle)
+	if ch.CtxChildCount() <= 1 {
+		ch.CtxGo(func() {
+			ticker := time.NewTicker(ch.domain.chAutoStopDelay)
+			defer ticker.Stop()
+
+			select {
+			case <-ticker.C:
+				ch.domain.stopChSessIfIdle(ch)
+			case <-ch.CtxStopping():
+				break
+			}
+		})
+	}
+}
+
+func (ch *chSess) ctxOnStopping() {
+	if N := len(ch.subs); N > 0 {
+		ch.Warnf("chSess being stopped with %d active subs", N)
+	}
+}
+
+// OpenChSub -- see interface Domain
+func (ch *chSess) OpenChSub(chReq *ChReq, reader MemberSession) (ChSub, error) {
+
+	sub := &chSub{
+		chSess:          ch,
+		chReq:           chReq,
+		reader:          readerKey(reader),
+		nodeOutbox:      make(chan *Node),
+		clientSuspended: true,
+	}
+
+	if chReq.GetOp.MaintainSync {
+		sub.txInbox = make(chan *mergedTxs, chSubBacklog)
+	}
+
+	// Start the subscription as a child ctx of each ch session
+	err := sub.CtxStart(
+		sub.ctxStartup,
+		nil,
+		nil,
+		sub.ctxStopping,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ch.CtxAddChild(sub, nil)
+
+	return sub, nil
+}
+
+func (ch *chSess) registerSub(sub *chSub) {
+	ch.subsMu.Lock()
+	ch.subs = append(ch.subs, sub)
+	ch.subsMu.Unlock()
+}
+
+func (ch *chSess) unregisterSub(remove *chSub) {
+	ch.subsMu.Lock()
+	N := len(ch.subs)
+	for i := 0; i < N; i++ {
+		if ch.subs[i] == remove {
+			N--
+			ch.subs[i] = ch.subs[N]
+			ch.subs[N] = nil
+			ch.subs = ch.subs[:N]
+			break
+		}
+	}
+	ch.subsMu.Unlock()
+}
+
+func (sub *chSub) Outbox() <-chan *Node {
+	return sub.nodeOutbox
+}
+
+func (sub *chSub) Close() {
+	sub.CtxStop("ch sub cancelled", nil)
+}
+
+func (sub *chSub) ctxStartup() error {
+	var err error
+
+	// Reading a channel as of an earlier time requires the same (current) rights as reading its current state
+	err = sub.chSess.checkReadAccess(sub.reader)
+	if err != nil {
+		return err
+	}
+
+	err = sub.scope.compile(sub.chReq.GetOp)
+	if err != nil {
+		return err
+	}
+
+	sub.asOf, sub.asOfVersion, err = sub.chSess.domain.resolveAsOf(sub.chReq.GetOp)
+	if err != nil {
+		return err
+	}
+	if sub.asOf != nil && sub.chReq.GetOp.MaintainSync {
+		return ErrCode_UnsupporteReqOp.ErrWithMsg("a point-in-time GetOp cannot maintain sync")
+	}
+
+	err = sub.filters.compile(sub.chReq.GetOp)
+	if err != nil {
+		return err
+	}
+
+	if sub.chReq.GetOp.SyncWindowMs > 0 {
+		sub.syncWindow = time.Duration(sub.chReq.GetOp.SyncWindowMs) * time.Millisecond
+	}
+
+	if len(sub.chReq.GetOp.StartAfter) > 0 {
+		sub.chReq.GetOp.StartAfter, err = NormalizeKeypath(sub.chReq.GetOp.StartAfter)
+		if err != nil {
+			return err
+		}
+	}
+	if sub.asOf != nil && (sub.chReq.GetOp.MaxNodes > 0 || len(sub.chReq.GetOp.StartAfter) > 0 || sub.chReq.GetOp.Reverse) {
+		return ErrCode_UnsupporteReqOp.ErrWithMsg("a point-in-time GetOp cannot be paged")
+	}
+
+	// Live changes aren't limited to the nodes sent, so a client would be sent changes to nodes beyond the page it was sent
+	if sub.chReq.GetOp.MaxNodes > 0 && sub.chReq.GetOp.MaintainSync {
+		return ErrCode_UnsupporteReqOp.ErrWithMsg("a paged GetOp cannot maintain sync")
+	}
+
+	chDesc := sub.chSess.GetLogLabel()
+	//sub.SetLogLabelf("%s/%s sub%03x", sub.chSess.GetLogLabel(), sub.chReq.GetOp.Keypath, sub.chReq.ReqID)
+	sub.SetLogLabelf("sub%03d …%s/%s", sub.chReq.ReqID, chDesc[len(chDesc)-5:], sub.chReq.GetOp.Keypath)
+
+	// Register before the state snapshot is read so that every tx committed after the snapshot is received.
+	// Txns already contained in the snapshot are skipped by comparing commit versions.
+	if sub.txInbox != nil {
+		sub.chSess.registerSub(sub)
+	}
+
+	sub.CtxGo(func() {
+
+		sub.sendStateToClient()
+
+		var batchDue <-chan time.Time
+
+		for {
+			if sub.clientSuspended {
+				sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_ChSyncResume, nil)
+				sub.clientSuspended = false
+			}
+
+			// If we're only sending state, we're done.
+			if sub.txInbox == nil {
+				break
+			}
+
+			// This blocks until new txs appear, a batch of changes is due, or until the sub is stopping (or if it never began)
+			var merged *mergedTxs
+			running := true
+			select {
+			case merged, running = <-sub.txInbox:
+			case <-batchDue:
+				batchDue = nil
+				sub.sendPendingChanges()
+				continue
 			}
-
-			// This blocks until new txs appear or until the sub is stopping (or if it never began)
-			tx, running := <-sub.txInbox
 			if running == false {
 				break
 			}
-			for _, change := range tx.TxOp.Entries {
-				sub.processChange(change)
+
+			// Nothing more is sent once the reader's ReadAccess is revoked (including the rest of the revoking commit).
+			// A sub that fell behind may have missed the revoking commit, so its reader's rights are checked before it resyncs.
+			outOfSync := atomic.LoadInt32(&sub.outOfSync) != 0
+			if (outOfSync || isACLChangeFor(merged, sub.reader)) && sub.chSess.checkReadAccess(sub.reader) != nil {
+				sub.CtxStop(readAccessRevoked, nil)
+				break
+			}
+			if outOfSync {
+				sub.resync()
+			}
+
+			// Commits arrive in commit order (see commitTxs), so those already reflected in the snapshot are skipped
+			if merged.version <= sub.snapshotVersion {
+				continue
+			}
+			for _, tx := range merged.txs {
+				for _, change := range tx.TxOp.Entries {
+					sub.processChange(change)
+				}
+			}
+
+			// The window for a batch starts with its first change
+			if len(sub.pending) > 0 && batchDue == nil {
+				batchDue = time.After(sub.syncWindow)
 			}
 		}
 
@@ -545,91 +1781,262 @@ func (sub *chSub) ctxStopping() {
 	}
 }
 
+// resync resends this sub's state from a fresh snapshot, following txns that were dropped because this sub fell behind.
+func (sub *chSub) resync() {
+	sub.Info(1, "resyncing")
+
+	if sub.clientSuspended == false {
+		sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_ChSyncSuspend, nil)
+		sub.clientSuspended = true
+	}
+
+	// Clear the flag before reading the snapshot so that a tx dropped from here on prompts another resync
+	atomic.StoreInt32(&sub.outOfSync, 0)
+
+	// Queued changes are superseded by the snapshot
+	sub.clearPendingChanges()
+
+	// Since dropped txns may have removed nodes, the client discards what it has for this sub before the snapshot is resent
+	for _, root := range sub.scope.roots {
+		reset := sub.chReq.newResponse(NodeOp_NodeRemoveAll, nil)
+		reset.Keypath = root.keypath
+		sub.nodeOutbox <- reset
+	}
+
+	sub.sendStateToClient()
+}
+
 func (sub *chSub) processChange(change *Node) {
-	scope := sub.chReq.GetOp.Scope
 
-	if strings.HasPrefix(change.Keypath, sub.chReq.GetOp.Keypath) {
-		N := len(sub.chReq.GetOp.Keypath)
-		subKey := change.Keypath[N:]
-		isMatch := false
+	// Removing a subtree that contains a keypath this sub matches removes everything this sub sees below it
+	if change.Op == NodeOp_NodeRemoveAll && sub.scope.isRemovedBy(change.Keypath) {
+		sub.sendChange(change)
+		return
+	}
+
+	if sub.scope.match(change.Keypath) && sub.filters.matchChange(change) {
+		sub.sendChange(change)
+	}
+}
+
+func (sub *chSub) sendChange(change *Node) {
+	node := sub.chReq.newResponseFromCopy(change)
+
+	if sub.syncWindow > 0 {
+		sub.queueChange(node)
+		return
+	}
+
+	if sub.clientSuspended == false {
+		sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_ChSyncSuspend, nil)
+		sub.clientSuspended = true
+	}
+
+	sub.Infof(2, "SYNC: %v %v", node.Op, node.Keypath)
+	sub.nodeOutbox <- node
+}
 
-		if (scope & KeypathScope_EntryAtKeypath) == KeypathScope_EntryAtKeypath {
-			isMatch = len(subKey) == 0
+// queueChange queues the given change to be sent with the next batch.
+// If coalescing updates, the change replaces any change already queued for the same keypath.
+// It is queued last (rather than in place) so that it still follows any queued removal of an ancestor.
+func (sub *chSub) queueChange(node *Node) {
+	if sub.chReq.GetOp.CoalesceUpdates {
+		if idx, exists := sub.pendingIdx[node.Keypath]; exists {
+			sub.pending[idx] = nil
 		}
-		if (scope & (KeypathScope_Shallow | KeypathScope_ShallowAndDeep)) != 0 {
-			if len(subKey) > 1 && subKey[0] == '/' {
-				if (scope & KeypathScope_Shallow) == KeypathScope_Shallow {
-					isMatch = strings.IndexByte(subKey[1:], '/') < 0
-				} else {
-					isMatch = true
-				}
-			}
+		if sub.pendingIdx == nil {
+			sub.pendingIdx = make(map[string]int)
 		}
+		sub.pendingIdx[node.Keypath] = len(sub.pending)
+	}
+	sub.pending = append(sub.pending, node)
+}
 
-		if isMatch {
-			if sub.clientSuspended == false {
-				sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_ChSyncSuspend, nil)
-				sub.clientSuspended = true
-			}
-			node := sub.chReq.newResponseFromCopy(change)
+// sendPendingChanges sends the batch of queued changes followed by a SyncStep.
+func (sub *chSub) sendPendingChanges() {
+	if len(sub.pending) == 0 {
+		return
+	}
 
-			sub.Infof(2, "SYNC: %v", node.Keypath)
+	for _, node := range sub.pending {
+		if node != nil {
+			sub.Infof(2, "SYNC: %v %v", node.Op, node.Keypath)
 			sub.nodeOutbox <- node
 		}
 	}
+	sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_SyncStep, nil)
+
+	sub.clearPendingChanges()
+}
 
+func (sub *chSub) clearPendingChanges() {
+	for i := range sub.pending {
+		sub.pending[i] = nil
+	}
+	sub.pending = sub.pending[:0]
+	for keypath := range sub.pendingIdx {
+		delete(sub.pendingIdx, keypath)
+	}
 }
 
-func (sub *chSub) unmarshalAndSend(itemPrefixSkip int, item *badger.Item) error {
-	return item.Value(func(entryBuf []byte) error {
+// readItem returns the node to send to the client for the given item read from this sub's channel (or nil if it isn't to be sent).
+// In keys-only mode, the item value is only read if needed to apply the TypeID filter.
+func (sub *chSub) readItem(keypath string, item *badger.Item) (*Node, error) {
+	sub.Infof(2, "GET: %v", keypath)
 
-		node, err := sub.chReq.newChEntry(entryBuf)
-		if err != nil {
-			return err
+	if sub.chReq.GetOp.KeysOnly && sub.filters.regexTypeID == nil {
+		if (item.UserMeta()&metaTombstone) != 0 || sub.filters.matchKeypath(keypath) == false {
+			return nil, nil
 		}
+		return sub.keyOnlyNode(keypath), nil
+	}
+
+	var node *Node
+	err := item.Value(func(entryBuf []byte) error {
+		var err error
+		node, err = sub.readStoredNode(keypath, entryBuf)
+		return err
+	})
+	if node != nil && sub.chReq.GetOp.KeysOnly {
+		node = sub.keyOnlyNode(keypath)
+	}
+	return node, err
+}
 
-		// TODO: use binary keypaths?
-		// node.Keypath = append(node.Keypath[:0], item.Key())
-		sub.Infof(2, "GET: %v", string(item.Key()))
+func (sub *chSub) keyOnlyNode(keypath string) *Node {
+	node := sub.chReq.newResponse(NodeOp_NodeUpdate, nil)
+	node.Keypath = keypath
+	return node
+}
 
-		node.Keypath = string(item.Key()[itemPrefixSkip:])
-		sub.Infof(2, "GET: %v", node.Keypath)
+// readStoredNode returns the node to send to the client for the given stored node value (or nil if it is a tombstone or doesn't pass this sub's filters).
+func (sub *chSub) readStoredNode(keypath string, entryBuf []byte) (*Node, error) {
+	if len(entryBuf) < revStampSz {
+		return nil, ErrCode_TxMalformed.ErrWithMsg("stored node missing revStamp")
+	}
+
+	// Check the keypath filter first to skip unmarshalling nodes that won't be sent
+	if sub.filters.matchKeypath(keypath) == false {
+		return nil, nil
+	}
+
+	node, err := sub.chReq.newChEntry(entryBuf[revStampSz:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Tombstones are only retained for conflict resolution
+	if node.Op != NodeOp_NodeUpdate || sub.filters.matchTypeID(node.TypeID) == false {
+		return nil, nil
+	}
+
+	node.Keypath = keypath
+	return node, nil
+}
 
+// sendStoredNode sends the given stored node value to the client (unless it is a tombstone or doesn't pass this sub's filters).
+func (sub *chSub) sendStoredNode(keypath string, entryBuf []byte) error {
+	node, err := sub.readStoredNode(keypath, entryBuf)
+	if node != nil {
+		sub.Infof(2, "GET: %v", node.Keypath)
 		sub.nodeOutbox <- node
-		return nil
-	})
+	}
+	return err
+}
+
+// statePage tracks the nodes sent for a GetOp that limits how many nodes are sent (see GetOp.MaxNodes).
+type statePage struct {
+	maxNodes    int32
+	sent        int32
+	lastKeypath string // keypath of the last node sent
+	hasMore     bool   // set if a node was left unsent
+}
+
+// send sends the given node to the client, returning false if the page is already full (in which case the node is not sent and the page has more nodes).
+func (page *statePage) send(sub *chSub, node *Node) bool {
+	if page.maxNodes > 0 && page.sent >= page.maxNodes {
+		page.hasMore = true
+		return false
+	}
+
+	page.sent++
+	page.lastKeypath = node.Keypath
+	sub.nodeOutbox <- node
+	return true
 }
 
 func (sub *chSub) sendStateToClient() {
-	scope := sub.chReq.GetOp.Scope
+	if sub.asOf != nil {
+		sub.sendHistoryToClient()
+		return
+	}
 
-	chPrefixLen := len(sub.chSess.keyPrefix)
-	opKeypath := append(sub.chSess.keyPrefix, sub.chReq.GetOp.Keypath...)
+	getOp := sub.chReq.GetOp
+	keyPrefix := sub.chSess.keyPrefix
+	chPrefixLen := len(keyPrefix)
 	readTxn := sub.chSess.stateDB.NewTransaction(false)
 	defer readTxn.Discard()
 
-	if (scope & KeypathScope_EntryAtKeypath) == KeypathScope_EntryAtKeypath {
-		sub.Infof(2, "GET  EntryAtPath: %v", string(opKeypath))
+	// Every tx committed at or before this version is contained in the snapshot
+	sub.snapshotVersion = readTxn.ReadTs()
 
-		item, err := readTxn.Get(opKeypath)
-		if err == nil {
-			err = sub.unmarshalAndSend(chPrefixLen, item)
-		}
-		if err != nil && err != badger.ErrKeyNotFound {
-			sub.Errorf("failed to read entry %v: %v", string(opKeypath), err)
-		}
+	page := statePage{
+		maxNodes: getOp.MaxNodes,
+	}
+
+	var cursor []byte
+	if len(getOp.StartAfter) > 0 {
+		cursor = AppendChKey(append([]byte{}, keyPrefix...), getOp.StartAfter)
 	}
 
-	if (scope & (KeypathScope_Shallow | KeypathScope_ShallowAndDeep)) != 0 {
-		shallowOnly := (scope & KeypathScope_ShallowAndDeep) == 0
+	var comps []string
+
+	// Each root is a separate range of keys, so reading the roots in order reads keys in order
+	for i := range sub.scope.roots {
+		root := sub.scope.roots[i]
+		if getOp.Reverse {
+			root = sub.scope.roots[len(sub.scope.roots)-1-i]
+		}
+		rootKey := append(append([]byte{}, keyPrefix...), root.key...)
+
+		if root.entryOnly {
+			sub.Infof(2, "GET  EntryAtPath: %v", root.keypath)
+
+			if cursor != nil {
+				if cmp := bytes.Compare(rootKey, cursor); cmp == 0 || (cmp < 0) != getOp.Reverse {
+					continue
+				}
+			}
+
+			item, err := readTxn.Get(rootKey)
+			var node *Node
+			if err == nil {
+				node, err = sub.readItem(root.keypath, item)
+			}
+			if err != nil && err != badger.ErrKeyNotFound {
+				sub.Errorf("failed to read entry %v: %v", root.keypath, err)
+			}
+			if node != nil && page.send(sub, node) == false {
+				break
+			}
+			continue
+		}
 
-		// Add a path sep char to ensure that we don't read items past the entry
 		opts := badger.DefaultIteratorOptions
-		opts.Prefix = append(opKeypath, '/')
+		opts.Prefix = rootKey
+		opts.Reverse = getOp.Reverse
+		opts.PrefetchValues = getOp.KeysOnly == false || sub.filters.regexTypeID != nil
 		itr := readTxn.NewIterator(opts)
-		defer itr.Close()
 
-		for itr.Rewind(); itr.Valid(); itr.Next() {
+		seekKey := rootKey
+		if getOp.Reverse {
+			seekKey = append(rootKey[:len(rootKey):len(rootKey)], 0xFF)
+		}
+		if cursor != nil && (bytes.Compare(cursor, seekKey) > 0) != getOp.Reverse {
+			seekKey = cursor
+		}
+
+		for itr.Seek(seekKey); itr.Valid(); itr.Next() {
 
 			// If the sub is cancelled, stop son!
 			if sub.CtxRunning() == false {
@@ -637,80 +2044,39 @@ func (sub *chSub) sendStateToClient() {
 			}
 
 			itrItem := itr.Item()
-			if shallowOnly && PathIsShallow(itrItem.Key(), opKeypath) == false {
+			if cursor != nil && bytes.Equal(itrItem.Key(), cursor) {
+				continue
+			}
+
+			var err error
+			itemKey := ChKey(itrItem.Key()[chPrefixLen:])
+			comps, err = itemKey.AppendComps(comps[:0])
+			if err != nil || sub.scope.matchComps(comps) == false {
 				continue
 			}
 
-			err := sub.unmarshalAndSend(chPrefixLen, itrItem)
+			node, err := sub.readItem(strings.Join(comps, "/"), itrItem)
 			if err != nil {
-				sub.Errorf("failed to itr item %v: %v", string(itrItem.Key()), err)
-			}
-		}
-	}
-}
-
-//     go func() {
-//     var syncTicker *time.Ticker
-//     var syncTickerChan <-chan time.Time
-
-//     // Send a SyncStep soon after we start to tell the client
-//     nodesSentThisTick := 1
-//     idleTicks := 0
-
-// 	for waiting := true; waiting; {
-// 		job.Debugf(">>> SUB STARTED   %v/%v:", job.req.ChURI, getOp.Keypath)
-
-// 		select {
-
-//         // Only send a sync msg after we've sent one or updates.
-//         case <-syncTickerChan:
-//             if nodesSentThisTick == 0 {
-//                 idleTicks++
-//                 if idleTicks > 10 {
-//                     syncTicker.Stop()
-//                     syncTickerChan = nil
-//                 }
-//             } else {
-//                 job.sess.msgOutlet <- job.newResponse(NodeOp_SyncStep)
-//                 idleTicks = 0
-//                 nodesSentThisTick = 0
-//             }
-
-// 		case <-job.canceled():
-// 			waiting = false
-
-// 		case rev := <-sub.States(): {
-//             changePath := rev.State.Keypath()
-//             common := opPath.CommonAncestor(changePath)
-
-//             job.Debugf(">>>  SUB %v/%v", job.req.ChURI, string(changePath))
-//             if common.Equals(opPath) {
-//                 job.Debugf(">>>  COM %v/%v     common: %v", job.req.ChURI, string(changePath), common)
-//                 if  true { //job.filterAndSendNode(rev.State.NodeAt(kNodeKey, nil)) {
-//                     nodesSentThisTick++
-//                 }
-//             }
-
-//             // Make sure the ticker is going once we start sending nodes
-//             if nodesSentThisTick == 1 {
-//                 if syncTickerChan == nil {
-//                     syncTicker = time.NewTicker(time.Millisecond * 200)
-//                     syncTickerChan = syncTicker.C
-//                 } else {
-//                     for len(syncTickerChan) > 0 {
-//                         <-syncTickerChan
-//                     }
-//                 }
-//             }
-//         } }
-// 	}
-
-//     if syncTickerChan != nil {
-//         syncTicker.Stop()
-//     }
+				sub.Errorf("failed to itr item %v: %v", itemKey, err)
+			}
+			if node != nil && page.send(sub, node) == false {
+				break
+			}
+		}
+		itr.Close()
+
+		if page.hasMore || sub.CtxRunning() == false {
+			break
+		}
+	}
 
-// 	subWait.Done()
-// }()
+	// Tell the client where to resume reading if this page didn't contain every node
+	if page.hasMore {
+		cont := sub.chReq.newResponse(NodeOp_ChStateContinuation, nil)
+		cont.Keypath = page.lastKeypath
+		sub.nodeOutbox <- cont
+	}
+}
 
 // SplitPath splits path immediately following the final slash, separating it into a directory and file name component.
 // If there is no slash in path, Split returns an empty dir and file set to path.
@@ -720,31 +2086,31 @@ func SplitPath(path []byte) (dir, file []byte) {
 	return path[:i+1], path[i+1:]
 }
 
-// PathIsShallow returns true if the item path's parent is the given parent path
-func PathIsShallow(path []byte, mustHaveParent []byte) bool {
-
-	// Skip last char to ignore trailing '/'
-	idx := len(path) - 1
-	for ; idx >= 0; idx-- {
-		if path[idx] == '/' {
-			return bytes.Equal(path[:idx], mustHaveParent)
-		}
+// PathIsShallow returns true if the given ChKey's parent is the given parent ChKey.
+//
+// Since a ChKey component leads with its length, only the single component following the parent is read.
+func PathIsShallow(key ChKey, mustHaveParent ChKey) bool {
+	if bytes.HasPrefix(key, mustHaveParent) == false || len(key) == len(mustHaveParent) {
+		return false
 	}
 
-	return len(mustHaveParent) == 0
+	comp := key[len(mustHaveParent):]
+	return int(comp[0])+1 == len(comp)
 }
 
 // NormalizeKeypath checks that there are no problems with the given keypath string and returns a standardized Keypath.
 //
-// This means removing a leading and trailing '/' (if present)
+// This means removing a leading and trailing '/' (if present).
+// Since each component is stored length-prefixed (see AppendChKey), a component can be any non-empty string (up to KeypathCompMaxSz bytes) without '/'.
+// A written keypath additionally can't have a glob component, since those are reserved for GetOp patterns (see normalizeEntries).
 func NormalizeKeypath(keypath string) (string, error) {
-	pathLen := len(keypath)
 
 	// Remove leading path sep char
-	if pathLen > 0 && keypath[0] == '/' {
+	if len(keypath) > 0 && keypath[0] == '/' {
 		keypath = keypath[1:]
 	}
 
+	pathLen := len(keypath)
 	if pathLen == 0 {
 		return "", ErrCode_InvalidKeypath.ErrWithMsg("keypath not set")
 	}
@@ -753,8 +2119,8 @@ func NormalizeKeypath(keypath string) (string, error) {
 	for i := 0; i <= pathLen; i++ {
 		if i == pathLen || keypath[i] == '/' {
 			compLen := i - sepIdx - 1
-			if compLen == 1 {
-				return "", ErrCode_InvalidKeypath.ErrWithMsg("keypath components cannot be a single character")
+			if compLen > KeypathCompMaxSz {
+				return "", ErrCode_InvalidKeypath.ErrWithMsgf("keypath component exceeds %d bytes", KeypathCompMaxSz)
 			} else if compLen == 0 {
 				if i < pathLen {
 					return "", ErrCode_InvalidKeypath.ErrWithMsg("keypath contains '//'")
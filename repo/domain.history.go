@@ -0,0 +1,180 @@
+package repo
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// histKeypath is the reserved keypath (under a domain's keyspace) where every revision of each channel node is stored.
+//
+// A revision is keyed by its channel LID, ChKey, and revStamp, so the revisions of a keypath iterate oldest to newest.
+const histKeypath = "/.hist/"
+
+// histKeySep separates a ChKey from the revStamp in a history key.
+// Since it reads as a zero length component (which no ChKey contains), all revisions of a keypath are adjacent and precede those of its children.
+const histKeySep = byte(0)
+
+// histKey returns the db key of the given revision of the keypath with the given ChKey in this channel's history.
+// If rev is nil, the returned key is the prefix of all revisions of the keypath.
+func (ch *chSess) histKey(chKey ChKey, rev *revStamp) []byte {
+	key := make([]byte, 0, len(ch.histPrefix)+len(chKey)+1+revStampSz)
+	key = append(append(key, ch.histPrefix...), chKey...)
+	key = append(key, histKeySep)
+	if rev != nil {
+		key = append(key, rev[:]...)
+	}
+	return key
+}
+
+// resolveAsOf returns the revStamp that a point-in-time GetOp reads as of (or nil if the GetOp reads the current state),
+// along with the db version that revisions must have been committed by (or 0 if revisions are not bounded by commit).
+//
+// Reading as of a TID reads the state as it was once that tx was committed on this host.
+// Since LWW leaves each keypath with its greatest revStamp committed so far, this is the greatest revision committed no later than that tx,
+// regardless of RevID or the order in which txns were merged.
+//
+// Reading as of a time includes every revision with a RevID up to and including that time.
+func (d *domain) resolveAsOf(getOp *GetOp) (*revStamp, uint64, error) {
+	rev := &revStamp{}
+	var version uint64
+
+	switch {
+	case len(getOp.AsOfTID) > 0:
+		if len(getOp.AsOfTID) != TIDSz {
+			return nil, 0, ErrCode_InvalidURI.ErrWithMsg("invalid AsOfTID")
+		}
+		var err error
+		version, err = d.readVersion(d.txLogKey(getOp.AsOfTID))
+		if err == badger.ErrKeyNotFound {
+			return nil, 0, ErrCode_InvalidURI.ErrWithMsgf("AsOfTID %v has not been merged", TID(getOp.AsOfTID).SuffixStr())
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		for i := range rev {
+			rev[i] = 0xFF
+		}
+	case getOp.AsOfTimeFS != 0:
+		rev.set(getOp.AsOfTimeFS, nil)
+		for i := 8; i < revStampSz; i++ {
+			rev[i] = 0xFF
+		}
+	default:
+		return nil, 0, nil
+	}
+
+	return rev, version, nil
+}
+
+// isAsOf returns true if the given history item is a revision that this sub's point-in-time read can include.
+func (sub *chSub) isAsOf(item *badger.Item, rev []byte) bool {
+	if sub.asOfVersion != 0 && item.Version() > sub.asOfVersion {
+		return false
+	}
+	return bytes.Compare(rev, sub.asOf[:]) <= 0
+}
+
+// sendHistoryToClient is the point-in-time analog of sendStateToClient, sending the revision of each node that was current as of sub.asOf.
+func (sub *chSub) sendHistoryToClient() {
+	ch := sub.chSess
+
+	readTxn := ch.stateDB.NewTransaction(false)
+	defer readTxn.Discard()
+
+	for _, root := range sub.scope.roots {
+		if sub.CtxRunning() == false {
+			return
+		}
+
+		if root.entryOnly {
+			keypath := root.keypath
+			sub.Infof(2, "GET  EntryAtPath: %v (as of %v)", keypath, sub.asOf.RevID())
+
+			// Seek to the latest revision no later than asOf
+			opts := badger.DefaultIteratorOptions
+			opts.Reverse = true
+			opts.Prefix = ch.histKey(root.key, nil)
+			itr := readTxn.NewIterator(opts)
+			for itr.Seek(ch.histKey(root.key, sub.asOf)); itr.Valid(); itr.Next() {
+				key := itr.Item().Key()
+				if sub.isAsOf(itr.Item(), key[len(key)-revStampSz:]) == false {
+					continue
+				}
+				err := itr.Item().Value(func(val []byte) error {
+					return sub.sendStoredNode(keypath, val)
+				})
+				if err != nil {
+					sub.Errorf("failed to read entry %v: %v", keypath, err)
+				}
+				break
+			}
+			itr.Close()
+			continue
+		}
+
+		sub.sendHistoryRange(readTxn, root.key)
+	}
+}
+
+// sendHistoryRange sends the revision current as of sub.asOf of each keypath under the given ChKey (inclusive) that is within this sub's scope.
+func (sub *chSub) sendHistoryRange(readTxn *badger.Txn, rootKey ChKey) {
+	ch := sub.chSess
+	prefixLen := len(ch.histPrefix)
+
+	var (
+		curKey ChKey
+		curVal []byte
+		comps  []string
+	)
+
+	// Sends the revision selected for curKey (if any)
+	flush := func() {
+		if curVal != nil {
+			var err error
+			comps, err = curKey.AppendComps(comps[:0])
+			if err == nil && sub.scope.matchComps(comps) {
+				err = sub.sendStoredNode(strings.Join(comps, "/"), curVal)
+			}
+			if err != nil {
+				sub.Errorf("failed to read entry %v: %v", curKey, err)
+			}
+		}
+		curVal = nil
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = append(append([]byte{}, ch.histPrefix...), rootKey...)
+	itr := readTxn.NewIterator(opts)
+	defer itr.Close()
+
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		if sub.CtxRunning() == false {
+			return
+		}
+
+		key := itr.Item().Key()
+		if len(key) < prefixLen+1+revStampSz {
+			continue
+		}
+		split := len(key) - revStampSz
+		itemKey := key[prefixLen : split-1]
+
+		if bytes.Equal(itemKey, curKey) == false {
+			flush()
+			curKey = append(curKey[:0], itemKey...)
+		}
+
+		// Revisions of a keypath ascend, so the last one no later than asOf is the one to send
+		if sub.isAsOf(itr.Item(), key[split:]) {
+			var err error
+			curVal, err = itr.Item().ValueCopy(curVal[:0])
+			if err != nil {
+				sub.Errorf("failed to read entry %v: %v", ChKey(itemKey), err)
+				curVal = nil
+			}
+		}
+	}
+	flush()
+}
@@ -0,0 +1,113 @@
+package repo
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/plan-systems/plan-go/device"
+)
+
+func TestAsOfTID(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, genesis := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	// older is authored first but merged last, and newer writes a revision with a RevID later than its TID
+	older := signTestTx(t, alice, uri, &Node{Keypath: "posts/older", Str: "older"})
+	newer := signTestTx(t, alice, uri,
+		&Node{Keypath: "posts/newer", Str: "newer"},
+		&Node{Keypath: "posts/future", Str: "future", RevID: int64(device.TimeNowFS()) + 3600<<16},
+	)
+	submitTestTx(t, A, newer)
+	submitTestTx(t, A, older)
+
+	expect := map[*Tx]string{
+		genesis: "posts/hello",
+		newer:   "posts/future posts/hello posts/newer",
+		older:   "posts/future posts/hello posts/newer posts/older",
+	}
+	for tx, keypaths := range expect {
+		if got := readKeypathsAsOf(t, A, alice, uri, "posts", KeypathScope_Shallow, tx.TID); got != keypaths {
+			t.Errorf("as of tx %v: expected %q, got %q", TID(tx.TID).SuffixStr(), keypaths, got)
+		}
+
+		// Reading a single entry agrees with reading its parent
+		entry := ""
+		if strings.Contains(keypaths, "posts/future") {
+			entry = "posts/future"
+		}
+		if got := readKeypathsAsOf(t, A, alice, uri, "posts/future", KeypathScope_EntryAtKeypath, tx.TID); got != entry {
+			t.Errorf("as of tx %v: expected %q, got %q", TID(tx.TID).SuffixStr(), entry, got)
+		}
+	}
+
+	// A tx that hasn't been merged has no point in time to read as of
+	unmerged := signTestTx(t, alice, uri, &Node{Keypath: "posts/unmerged", Str: "unmerged"})
+	_, err := A.OpenChSub(&ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath: "posts",
+			Scope:   KeypathScope_Shallow,
+			AsOfTID: unmerged.TID,
+		},
+	}, alice)
+	if err == nil {
+		t.Fatal("expected reading as of an unmerged tx to fail")
+	}
+}
+
+func TestAsOfTimeFS(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	revID := int64(device.TimeNowFS())
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/val", Str: "first", RevID: revID})
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/val", Str: "second", RevID: revID + 20}))
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Op: NodeOp_NodeRemove, Keypath: "posts/val", RevID: revID + 40}))
+
+	// Each point in time sees the revision current then (and nothing once it was removed)
+	expect := map[int64]string{
+		revID - 1:  "",
+		revID:      "first",
+		revID + 30: "second",
+		revID + 50: "",
+	}
+	for asOf, str := range expect {
+		nodes := readNodes(t, A, alice, &ChReq{
+			ChStateURI: uri,
+			GetOp: &GetOp{
+				Keypath:    "posts/val",
+				Scope:      KeypathScope_EntryAtKeypath,
+				AsOfTimeFS: asOf,
+			},
+		})
+		got := ""
+		if len(nodes) > 0 {
+			got = nodes[0].Str
+		}
+		if got != str {
+			t.Errorf("as of %d: expected %q, got %q", asOf-revID, str, got)
+		}
+	}
+}
+
+// readKeypathsAsOf returns the sorted keypaths (joined by spaces) read from the given keypath and scope as of the given tx.
+func readKeypathsAsOf(t *testing.T, host Host, reader MemberSession, uri *ChStateURI, keypath string, scope KeypathScope, asOfTID []byte) string {
+	nodes := readNodes(t, host, reader, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath: keypath,
+			Scope:   scope,
+			AsOfTID: asOfTID,
+		},
+	})
+
+	var keypaths []string
+	for _, node := range nodes {
+		keypaths = append(keypaths, node.Keypath)
+	}
+	sort.Strings(keypaths)
+	return strings.Join(keypaths, " ")
+}
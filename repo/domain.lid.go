@@ -0,0 +1,248 @@
+package repo
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/plan-systems/plan-go/bufs"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// LID is a local ID, a compact integer issued to each channel of a domain (and to each domain of a host) from a db sequence.
+// Since a LID is only meaningful to the db it was issued in, it names a keyspace in db keys but never leaves the host.
+//
+// Any number of names can map to the same LID (see lidTable), so a channel or domain can be aliased or renamed without rewriting its keys.
+type LID uint32
+
+// domainLIDsKeypath is the reserved host-level keypath where the LID of each domain name is stored (see lidTable).
+const domainLIDsKeypath = "/.domains"
+
+// chLIDsKeypath is the reserved keypath (under a domain's keyspace) where the LID of each ChID and channel alias is stored (see lidTable).
+const chLIDsKeypath = "/.chlids"
+
+// lidKeySz is the byte size of a LID within a db key (see appendLIDKey).
+const lidKeySz = 1 + 4
+
+// lidKeyMark leads each LID within a db key so that a keyspace named by a LID never collides with a reserved keypath (which leads with '/' or '.').
+// Like the base32 ChIDs that LIDs replace, it sorts after the reserved keypaths of a domain.
+const lidKeyMark = '~'
+
+// lidSeqKeypath is the reserved host-level keypath of the db sequence that issues every LID of a host (see openLIDSeq).
+const lidSeqKeypath = "/.lidseq"
+
+// lidLeaseSz is the number of LIDs leased from a host's LID sequence at a time.
+const lidLeaseSz = 100
+
+// appendLIDKey appends the given LID (as it appears within a db key) to the given key.
+func appendLIDKey(key []byte, lid LID) []byte {
+	return append(key, lidKeyMark, byte(lid>>24), byte(lid>>16), byte(lid>>8), byte(lid))
+}
+
+// isChID returns true if the given string has the form of a ChID: a base32 encoded TID.
+// A channel alias can't have this form, so an alias never shadows a channel ID.
+func isChID(chID string) bool {
+	if len(chID) != TIDEncodedLen {
+		return false
+	}
+	var tid TIDBuf
+	n, err := bufs.Base32Encoding.Decode(tid[:], []byte(chID))
+	return err == nil && n == TIDSz
+}
+
+// openLIDSeq returns the sequence that issues every LID of the given host db.
+//
+// A db has exactly one LID sequence, held open for as long as the db is: since releasing a sequence returns its unused lease,
+// a sequence opened (and released) each time a lidTable is would reissue LIDs leased by another still in use.
+func openLIDSeq(db *badger.DB) (*badger.Sequence, error) {
+	return db.GetSequence([]byte(lidSeqKeypath), lidLeaseSz)
+}
+
+// lidTable maps names to the LIDs it issues, where each LID has a primary name and any number of aliases.
+//
+// Names are only ever added, so a name resolved to a LID is cached for the life of the table.
+type lidTable struct {
+	db       *badger.DB
+	namesKey []byte // leads the key of each name, holding the LID it maps to
+	lidsKey  []byte // leads the key of each LID, holding its primary name
+	seq      *badger.Sequence
+	lids     map[string]LID
+	mu       sync.Mutex
+}
+
+// open readies this table to map names stored under the given db key prefix and keypath, issuing LIDs from the given db sequence (see openLIDSeq).
+func (tbl *lidTable) open(db *badger.DB, seq *badger.Sequence, keyPrefix []byte, keypath string) {
+	base := append(append([]byte{}, keyPrefix...), keypath...)
+	tbl.db = db
+	tbl.seq = seq
+	tbl.namesKey = append(append([]byte{}, base...), "/names/"...)
+	tbl.lidsKey = append(append([]byte{}, base...), "/lids/"...)
+	tbl.lids = make(map[string]LID)
+}
+
+func (tbl *lidTable) nameKey(name string) []byte {
+	key := make([]byte, 0, len(tbl.namesKey)+len(name))
+	return append(append(key, tbl.namesKey...), name...)
+}
+
+func (tbl *lidTable) lidKey(lid LID) []byte {
+	return appendLIDKey(append(make([]byte, 0, len(tbl.lidsKey)+lidKeySz), tbl.lidsKey...), lid)
+}
+
+// lookup returns the LID the given name maps to (or 0 if the name maps to no LID).
+func (tbl *lidTable) lookup(name string) (LID, error) {
+	tbl.mu.Lock()
+	defer tbl.mu.Unlock()
+
+	return tbl.lookupLocked(name)
+}
+
+// Pre: tbl.mu is locked
+func (tbl *lidTable) lookupLocked(name string) (LID, error) {
+	if lid := tbl.lids[name]; lid != 0 {
+		return lid, nil
+	}
+
+	var lid LID
+	err := tbl.db.View(func(dbTx *badger.Txn) error {
+		var err error
+		lid, err = tbl.readLID(dbTx, name)
+		return err
+	})
+	if err != nil {
+		return 0, ErrCode_CommitFailed.Wrap(err)
+	}
+	if lid != 0 {
+		tbl.lids[name] = lid
+	}
+	return lid, nil
+}
+
+func (tbl *lidTable) readLID(dbTx *badger.Txn, name string) (LID, error) {
+	item, err := dbTx.Get(tbl.nameKey(name))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+
+	var lid LID
+	if err == nil {
+		err = item.Value(func(val []byte) error {
+			if len(val) != 4 {
+				return ErrCode_CommitFailed.ErrWithMsgf("malformed LID for %q", name)
+			}
+			lid = LID(binary.BigEndian.Uint32(val))
+			return nil
+		})
+	}
+	return lid, err
+}
+
+// issue returns the LID the given name maps to, issuing a new LID (with the given name as its primary name) if it maps to none.
+func (tbl *lidTable) issue(name string) (LID, error) {
+	tbl.mu.Lock()
+	defer tbl.mu.Unlock()
+
+	lid, err := tbl.lookupLocked(name)
+	if lid != 0 || err != nil {
+		return lid, err
+	}
+
+	// Another table for the same keyspace (e.g. one still stopping) may issue concurrently, so retry on conflict
+	for retries := 0; retries < commitConflictRetries; retries++ {
+		err = tbl.db.Update(func(dbTx *badger.Txn) error {
+			var err error
+			lid, err = tbl.readLID(dbTx, name)
+			if lid != 0 || err != nil {
+				return err
+			}
+
+			// LID 0 denotes no LID, so it is never issued
+			for lid == 0 {
+				var next uint64
+				next, err = tbl.seq.Next()
+				if err != nil {
+					return err
+				}
+				lid = LID(next)
+			}
+
+			err = tbl.setLID(dbTx, name, lid)
+			if err == nil {
+				err = dbTx.Set(tbl.lidKey(lid), []byte(name))
+			}
+			return err
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err != nil {
+		return 0, ErrCode_CommitFailed.Wrap(err)
+	}
+
+	tbl.lids[name] = lid
+	return lid, nil
+}
+
+func (tbl *lidTable) setLID(dbTx *badger.Txn, name string, lid LID) error {
+	var val [4]byte
+	binary.BigEndian.PutUint32(val[:], uint32(lid))
+	return dbTx.Set(tbl.nameKey(name), val[:])
+}
+
+// alias maps the given name to the given LID, also making it the LID's primary name if isPrimary is set.
+// A name already mapped to another LID can't be reused.
+func (tbl *lidTable) alias(name string, lid LID, isPrimary bool) error {
+	if len(name) == 0 || strings.IndexByte(name, '/') >= 0 {
+		return ErrCode_InvalidURI.ErrWithMsgf("invalid alias %q", name)
+	}
+
+	tbl.mu.Lock()
+	defer tbl.mu.Unlock()
+
+	err := tbl.db.Update(func(dbTx *badger.Txn) error {
+		existing, err := tbl.readLID(dbTx, name)
+		if err != nil {
+			return err
+		}
+		if existing != 0 && existing != lid {
+			return ErrCode_InvalidURI.ErrWithMsgf("%q is already in use", name)
+		}
+
+		if existing == 0 {
+			err = tbl.setLID(dbTx, name, lid)
+		}
+		if err == nil && isPrimary {
+			err = dbTx.Set(tbl.lidKey(lid), []byte(name))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	tbl.lids[name] = lid
+	return nil
+}
+
+// primaryName returns the primary name of the given LID.
+func (tbl *lidTable) primaryName(lid LID) (string, error) {
+	var name string
+
+	err := tbl.db.View(func(dbTx *badger.Txn) error {
+		item, err := dbTx.Get(tbl.lidKey(lid))
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				name = string(val)
+				return nil
+			})
+		}
+		return err
+	})
+	if err != nil {
+		return "", ErrCode_CommitFailed.Wrap(err)
+	}
+
+	return name, nil
+}
@@ -0,0 +1,117 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestLIDTable(t *testing.T) {
+	A := startTestHost(t).(*host)
+
+	// Tables sharing the host's sequence never issue the same LID
+	var tblA, tblB lidTable
+	tblA.open(A.stateDB, A.lidSeq, []byte("/test-a"), chLIDsKeypath)
+	tblB.open(A.stateDB, A.lidSeq, []byte("/test-b"), chLIDsKeypath)
+
+	issued := make(map[LID]bool)
+	for _, tbl := range []*lidTable{&tblA, &tblB} {
+		for _, name := range []string{"one", "two"} {
+			lid, err := tbl.issue(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := tbl.issue(name); again != lid {
+				t.Fatalf("expected %q to keep LID %v, got %v", name, lid, again)
+			}
+			if issued[lid] {
+				t.Fatalf("LID %v issued twice", lid)
+			}
+			issued[lid] = true
+		}
+	}
+
+	// An alias maps to the same LID, and a primary alias renames it
+	lid, _ := tblA.lookup("one")
+	if err := tblA.alias("uno", lid, true); err != nil {
+		t.Fatal(err)
+	}
+	if aliased, _ := tblA.lookup("uno"); aliased != lid {
+		t.Fatalf("expected alias to map to %v, got %v", lid, aliased)
+	}
+	if name, _ := tblA.primaryName(lid); name != "uno" {
+		t.Fatalf("expected primary name 'uno', got %q", name)
+	}
+	if err := tblA.alias("two", lid, false); err == nil {
+		t.Fatal("expected a name in use to be refused as an alias")
+	}
+}
+
+func TestChAndDomainAliases(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	if err := A.AliasCh(uri, "general"); err != nil {
+		t.Fatal(err)
+	}
+	if err := A.AliasDomain(testDomain, "alias-domain"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A channel read via its aliases is the same channel
+	aliased := &ChStateURI{DomainName: "alias-domain", ChID: "general"}
+	if got := readEntryStr(t, A, alice, aliased, "posts/hello"); got != "hello" {
+		t.Fatalf("expected to read via aliases, got %q", got)
+	}
+
+	// An alias can't shadow a channel ID
+	other, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/other", Str: "other"})
+	if err := A.AliasCh(uri, other.ChID); err == nil {
+		t.Fatal("expected an alias in the form of a channel ID to be refused")
+	}
+}
+
+func TestReadsDontIssueLIDs(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	expectCode := func(err error, code ErrCode) {
+		t.Helper()
+		if reqErr := toReqErr(err); reqErr == nil || reqErr.Code != code {
+			t.Fatalf("expected %v, got %v", code, reqErr)
+		}
+	}
+
+	// Reading a domain never seen here fails without issuing it a LID
+	_, err := A.OpenTxFeed("unknown-domain", 0)
+	expectCode(err, ErrCode_DomainNotFound)
+	_, err = A.OpenChDir(&ChReq{ChStateURI: &ChStateURI{DomainName: "unknown-domain"}})
+	expectCode(err, ErrCode_DomainNotFound)
+	if lid, _ := A.(*host).domainLIDs.lookup("unknown-domain"); lid != 0 {
+		t.Fatal("expected no LID to be issued to an unknown domain")
+	}
+
+	// Likewise for a channel
+	unknownTID := make([]byte, Const_TIDSz)
+	unknownTID[len(unknownTID)-1] = 1
+	unknown := &ChStateURI{
+		DomainName: testDomain,
+		ChID:       TID(unknownTID).Base32(),
+		ChID_TID:   unknownTID,
+	}
+	_, err = A.OpenChSub(&ChReq{ChStateURI: unknown, GetOp: &GetOp{Keypath: "posts", Scope: KeypathScope_Shallow}}, alice)
+	expectCode(err, ErrCode_ChNotFound)
+	_, err = A.OpenChTxFeed(unknown, nil, false, alice)
+	expectCode(err, ErrCode_ChNotFound)
+	expectCode(A.AliasCh(unknown, "general"), ErrCode_ChNotFound)
+
+	d, err := A.(*host).holdDomain(testDomain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.(*host).releaseDomain(d)
+	if lid, _ := d.chLIDs.lookup(unknown.ChID); lid != 0 {
+		t.Fatal("expected no LID to be issued to an unknown channel")
+	}
+}
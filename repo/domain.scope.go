@@ -0,0 +1,185 @@
+package repo
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Keypath pattern components (see GetOp.Keypaths) that match any single keypath component and any number of components (including none).
+const (
+	keypathGlobOne = "*"
+	keypathGlobAny = "**"
+)
+
+// subScope determines which keypaths a chSub sees: each keypath within the GetOp scope of a keypath that matches one of the sub's patterns.
+//
+// A keypath at depth 0 (the matching keypath itself) is within KeypathScope_EntryAtKeypath, depth 1 is within KeypathScope_Shallow,
+// and any depth is within KeypathScope_ShallowAndDeep (unless limited by GetOp.MaxDepth).
+type subScope struct {
+	patterns [][]string // the components of each keypath pattern
+	roots    []scopeRoot
+	scope    KeypathScope
+	maxDepth int
+}
+
+// scopeRoot is a range of keypaths to read in order to find every keypath within a subScope.
+type scopeRoot struct {
+	keypath   string // every keypath in range is (or is under) this keypath
+	key       ChKey  // the ChKey of keypath, leading the ChKey of every keypath in range
+	entryOnly bool   // set if only the keypath itself is in range
+}
+
+// compile sets up this scope from the given GetOp's keypaths (normalizing each one) and scope.
+func (ss *subScope) compile(getOp *GetOp) error {
+	ss.scope = getOp.Scope
+	ss.maxDepth = int(getOp.MaxDepth)
+
+	var err error
+	getOp.Keypath, err = NormalizeKeypath(getOp.Keypath)
+	if err != nil {
+		return err
+	}
+	for i := range getOp.Keypaths {
+		getOp.Keypaths[i], err = NormalizeKeypath(getOp.Keypaths[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	ss.patterns = make([][]string, 0, 1+len(getOp.Keypaths))
+	ss.roots = make([]scopeRoot, 0, cap(ss.patterns))
+	for _, keypath := range append([]string{getOp.Keypath}, getOp.Keypaths...) {
+		pattern := splitKeypath(keypath)
+		ss.patterns = append(ss.patterns, pattern)
+
+		// Only the leading components before a glob narrow the range to read
+		N := 0
+		for N < len(pattern) && pattern[N] != keypathGlobOne && pattern[N] != keypathGlobAny {
+			N++
+		}
+		root := scopeRoot{
+			keypath:   strings.Join(pattern[:N], "/"),
+			entryOnly: N == len(pattern) && (ss.scope&(KeypathScope_Shallow|KeypathScope_ShallowAndDeep)) == 0,
+		}
+		root.key = AppendChKey(nil, root.keypath)
+		ss.roots = append(ss.roots, root)
+	}
+
+	// Order the roots (as their keys are ordered) and drop those contained by another so that reading each root in turn reads keypaths in order, each once
+	sort.Slice(ss.roots, func(i, j int) bool {
+		if cmp := bytes.Compare(ss.roots[i].key, ss.roots[j].key); cmp != 0 {
+			return cmp < 0
+		}
+		return ss.roots[j].entryOnly
+	})
+	N := 0
+	for _, root := range ss.roots {
+		if N > 0 {
+			prev := ss.roots[N-1]
+			if bytes.Equal(prev.key, root.key) || (prev.entryOnly == false && bytes.HasPrefix(root.key, prev.key)) {
+				continue
+			}
+		}
+		ss.roots[N] = root
+		N++
+	}
+	ss.roots = ss.roots[:N]
+
+	return nil
+}
+
+// match returns true if the given keypath is within this scope.
+func (ss *subScope) match(keypath string) bool {
+	return ss.matchComps(splitKeypath(keypath))
+}
+
+// matchComps is match for a keypath already split into its components.
+func (ss *subScope) matchComps(comps []string) bool {
+	for _, pattern := range ss.patterns {
+		if matchPattern(pattern, comps, ss.inScope) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRemovedBy returns true if removing the subtree at the given keypath removes every keypath within this scope below some matching keypath.
+func (ss *subScope) isRemovedBy(keypath string) bool {
+	comps := splitKeypath(keypath)
+	for _, pattern := range ss.patterns {
+		if patternCovers(pattern, comps) {
+			return true
+		}
+	}
+	return false
+}
+
+// inScope returns true if a keypath at the given depth below a matching keypath is within this scope.
+func (ss *subScope) inScope(depth int) bool {
+	switch {
+	case depth == 0:
+		return (ss.scope & KeypathScope_EntryAtKeypath) != 0
+	case depth == 1:
+		return (ss.scope & (KeypathScope_Shallow | KeypathScope_ShallowAndDeep)) != 0
+	default:
+		return (ss.scope&KeypathScope_ShallowAndDeep) != 0 && (ss.maxDepth <= 0 || depth <= ss.maxDepth)
+	}
+}
+
+// matchPattern returns true if a leading part of the given keypath components matches the given pattern
+// and the remaining depth (the number of components left over) is accepted.
+func matchPattern(pattern, comps []string, accept func(depth int) bool) bool {
+	if len(pattern) == 0 {
+		return accept(len(comps))
+	}
+
+	switch pattern[0] {
+	case keypathGlobAny:
+		if matchPattern(pattern[1:], comps, accept) {
+			return true
+		}
+		return len(comps) > 0 && matchPattern(pattern, comps[1:], accept)
+	case keypathGlobOne:
+		return len(comps) > 0 && matchPattern(pattern[1:], comps[1:], accept)
+	default:
+		return len(comps) > 0 && pattern[0] == comps[0] && matchPattern(pattern[1:], comps[1:], accept)
+	}
+}
+
+// patternCovers returns true if the given keypath components could be (or lead) a keypath that matches the given pattern.
+func patternCovers(pattern, comps []string) bool {
+	if len(comps) == 0 {
+		return true
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+
+	switch pattern[0] {
+	case keypathGlobAny:
+		return true
+	case keypathGlobOne:
+		return patternCovers(pattern[1:], comps[1:])
+	default:
+		return pattern[0] == comps[0] && patternCovers(pattern[1:], comps[1:])
+	}
+}
+
+func splitKeypath(keypath string) []string {
+	if len(keypath) == 0 {
+		return nil
+	}
+	return strings.Split(keypath, "/")
+}
+
+// hasGlobComp returns true if the given (normalized) keypath has a component that is a glob.
+// Since a pattern can't tell a glob from a literal component, only GetOp patterns can have them (see normalizeEntries).
+func hasGlobComp(keypath string) bool {
+	for _, comp := range splitKeypath(keypath) {
+		if comp == keypathGlobOne || comp == keypathGlobAny {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestSubScopeMatch(t *testing.T) {
+	tests := []struct {
+		getOp   GetOp
+		matches []string
+		misses  []string
+	}{
+		{
+			GetOp{Keypath: "posts", Scope: KeypathScope_Shallow},
+			[]string{"posts/a"},
+			[]string{"posts", "posts/a/b", "users/a"},
+		}, {
+			GetOp{Keypath: "posts", Scope: KeypathScope_EntryAtKeypath | KeypathScope_ShallowAndDeep, MaxDepth: 2},
+			[]string{"posts", "posts/a", "posts/a/b"},
+			[]string{"posts/a/b/c", "postsx"},
+		}, {
+			GetOp{Keypath: "users/*/name", Scope: KeypathScope_EntryAtKeypath},
+			[]string{"users/ann/name"},
+			[]string{"users/name", "users/ann/x/name", "users/ann/name/first"},
+		}, {
+			GetOp{Keypath: "users/**/name", Scope: KeypathScope_EntryAtKeypath},
+			[]string{"users/name", "users/ann/name", "users/ann/x/name"},
+			[]string{"users/ann/age"},
+		}, {
+			GetOp{Keypath: "posts", Keypaths: []string{"users/*"}, Scope: KeypathScope_EntryAtKeypath},
+			[]string{"posts", "users/ann"},
+			[]string{"posts/a", "users/ann/name"},
+		},
+	}
+	for _, test := range tests {
+		var ss subScope
+		if err := ss.compile(&test.getOp); err != nil {
+			t.Fatal(err)
+		}
+		for _, keypath := range test.matches {
+			if ss.match(keypath) == false {
+				t.Errorf("%q %v: expected %q to match", test.getOp.Keypath, test.getOp.Keypaths, keypath)
+			}
+		}
+		for _, keypath := range test.misses {
+			if ss.match(keypath) {
+				t.Errorf("%q %v: expected %q not to match", test.getOp.Keypath, test.getOp.Keypaths, keypath)
+			}
+		}
+	}
+}
+
+func TestGlobScopeRead(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice,
+		&Node{Keypath: "users/ann/name", Str: "Ann"},
+		&Node{Keypath: "users/bob/name", Str: "Bob"},
+		&Node{Keypath: "users/bob/age", Int: 42},
+		&Node{Keypath: "posts/hello", Str: "hello"},
+	)
+
+	nodes := readNodes(t, A, alice, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:  "users/*/name",
+			Keypaths: []string{"posts/hello"},
+			Scope:    KeypathScope_EntryAtKeypath,
+		},
+	})
+	if got, expect := joinKeypaths(nodes), "posts/hello users/ann/name users/bob/name"; got != expect {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+}
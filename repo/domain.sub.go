@@ -0,0 +1,175 @@
+package repo
+
+import (
+	"github.com/plan-systems/plan-go/ctx"
+)
+
+// domainSubBacklog is the number of merged commits queued for a domainSub before it is considered to have fallen behind.
+const domainSubBacklog = 64
+
+// domainSubFellBehind is the stop reason of a domainSub that could not keep up with the domain's merge loop.
+const domainSubFellBehind = "domain sub fell behind"
+
+// domainSub streams each change merged into any channel of a domain that is within its GetOp scope and filters.
+// Each change sent is tagged with the ChID of its channel and each commit's changes are followed by a SyncStep.
+//
+// Unlike a chSub, a domainSub only sends changes merged after it is opened (there is no initial state to send).
+type domainSub struct {
+	ctx.Context
+
+	domain     *domain
+	chReq      *ChReq
+	reader     []byte       // pub key of the member reading (see checkReadAccess)
+	readable   map[LID]bool // whether the reader can read each channel changes were merged into (see canRead)
+	scope      subScope
+	filters    nodeFilters
+	nodeOutbox chan *Node
+	txInbox    chan *mergedTxs
+}
+
+// OpenDomainSub -- see interface Domain
+func (d *domain) OpenDomainSub(chReq *ChReq, reader MemberSession) (ChSub, error) {
+	if chReq.GetOp == nil {
+		return nil, ErrCode_UnsupporteReqOp.ErrWithMsg("missing GetOp")
+	}
+
+	pubKey := readerKey(reader)
+	if len(pubKey) == 0 {
+		return nil, ErrCode_AccessDenied.ErrWithMsg("member access not expanded")
+	}
+
+	sub := &domainSub{
+		domain:     d,
+		chReq:      chReq,
+		reader:     pubKey,
+		readable:   make(map[LID]bool),
+		nodeOutbox: make(chan *Node),
+		txInbox:    make(chan *mergedTxs, domainSubBacklog),
+	}
+
+	err := sub.CtxStart(
+		sub.ctxStartup,
+		nil,
+		nil,
+		sub.ctxStopping,
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.CtxAddChild(sub, nil)
+
+	return sub, nil
+}
+
+func (d *domain) registerDomainSub(sub *domainSub) {
+	d.domainSubsMu.Lock()
+	d.domainSubs = append(d.domainSubs, sub)
+	d.domainSubsMu.Unlock()
+}
+
+func (d *domain) unregisterDomainSub(remove *domainSub) {
+	d.domainSubsMu.Lock()
+	N := len(d.domainSubs)
+	for i := 0; i < N; i++ {
+		if d.domainSubs[i] == remove {
+			N--
+			d.domainSubs[i] = d.domainSubs[N]
+			d.domainSubs[N] = nil
+			d.domainSubs = d.domainSubs[:N]
+			break
+		}
+	}
+	d.domainSubsMu.Unlock()
+}
+
+// broadcastToDomainSubs queues the given txns merged into a channel for each domainSub.
+// Since this is called from a merge worker, it never blocks: a sub that has fallen behind is stopped, leaving its consumer to reopen it.
+func (d *domain) broadcastToDomainSubs(merged *mergedTxs) {
+	d.domainSubsMu.RLock()
+	for _, sub := range d.domainSubs {
+		select {
+		case sub.txInbox <- merged:
+		default:
+			go sub.CtxStop(domainSubFellBehind, nil)
+		}
+	}
+	d.domainSubsMu.RUnlock()
+}
+
+// Outbox -- see interface ChSub
+func (sub *domainSub) Outbox() <-chan *Node {
+	return sub.nodeOutbox
+}
+
+// Close -- see interface ChSub
+func (sub *domainSub) Close() {
+	sub.CtxStop("domain sub cancelled", nil)
+}
+
+func (sub *domainSub) ctxStartup() error {
+	err := sub.scope.compile(sub.chReq.GetOp)
+	if err == nil {
+		err = sub.filters.compile(sub.chReq.GetOp)
+	}
+	if err != nil {
+		return err
+	}
+
+	sub.SetLogLabelf("sub%03d %s/*/%s", sub.chReq.ReqID, sub.domain.domainName, sub.chReq.GetOp.Keypath)
+
+	sub.domain.registerDomainSub(sub)
+
+	sub.CtxGo(func() {
+		for merged := range sub.txInbox {
+			if sub.canRead(merged) == false {
+				continue
+			}
+			sent := false
+			for _, tx := range merged.txs {
+				for _, change := range tx.TxOp.Entries {
+					if sub.isMatch(change) {
+						node := sub.chReq.newResponseFromCopy(change)
+						node.ChID = merged.ch.ChID
+						sub.Infof(2, "SYNC: %v %v/%v", node.Op, node.ChID, node.Keypath)
+						sub.nodeOutbox <- node
+						sent = true
+					}
+				}
+			}
+			if sent {
+				sub.nodeOutbox <- sub.chReq.newResponse(NodeOp_SyncStep, nil)
+			}
+		}
+
+		close(sub.nodeOutbox)
+	})
+
+	return nil
+}
+
+func (sub *domainSub) ctxStopping() {
+	sub.Info(2, "stopping")
+
+	sub.domain.unregisterDomainSub(sub)
+	close(sub.txInbox)
+}
+
+// canRead returns true if this sub's reader has ReadAccess to the channel the given txns were merged into.
+// Rights are read as they stand when the txns are sent, so a sub that lags behind may withhold changes merged before a revocation.
+// A channel's rights are read once and then again only when a change to the reader's ACL entry is merged there.
+func (sub *domainSub) canRead(merged *mergedTxs) bool {
+	readable, known := sub.readable[merged.ch.lid]
+	if known == false || isACLChangeFor(merged, sub.reader) {
+		readable = merged.ch.checkReadAccess(sub.reader) == nil
+		sub.readable[merged.ch.lid] = readable
+	}
+	return readable
+}
+
+// isMatch returns true if the given change is to be sent (see chSub.processChange).
+func (sub *domainSub) isMatch(change *Node) bool {
+	if change.Op == NodeOp_NodeRemoveAll && sub.scope.isRemovedBy(change.Keypath) {
+		return true
+	}
+	return sub.scope.match(change.Keypath) && sub.filters.matchChange(change)
+}
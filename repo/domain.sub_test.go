@@ -0,0 +1,279 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSubHandoffIsGapless(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	// Open the sub while txns are being merged, so some are in its snapshot and the rest follow live
+	const numTxs = 40
+	var pending []TxCompletion
+	var sub ChSub
+	for i := 0; i < numTxs; i++ {
+		txDone, err := A.SubmitTx(signTestTx(t, alice, uri, &Node{Keypath: fmt.Sprintf("posts/val%02d", i), Int: int64(i)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, txDone)
+
+		if i == numTxs/2 {
+			sub = openTestSub(t, A, alice, &ChReq{
+				ChStateURI: uri,
+				GetOp: &GetOp{
+					Keypath:      "posts",
+					Scope:        KeypathScope_Shallow,
+					MaintainSync: true,
+				},
+			})
+		}
+	}
+	for _, txDone := range pending {
+		if err := waitForTx(t, txDone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/last", Str: "last"}))
+
+	seen := make(map[string]bool)
+	for _, node := range readSubUntil(t, sub, "posts/last") {
+		seen[node.Keypath] = true
+	}
+	for i := 0; i < numTxs; i++ {
+		if keypath := fmt.Sprintf("posts/val%02d", i); seen[keypath] == false {
+			t.Errorf("sub missed %v", keypath)
+		}
+	}
+}
+
+func TestSlowSubResyncs(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	sub := openTestSub(t, A, alice, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:      "posts",
+			Scope:        KeypathScope_Shallow,
+			MaintainSync: true,
+		},
+	})
+
+	// A sub that isn't read doesn't hold up merging
+	for i := 0; i < 3*chSubBacklog; i++ {
+		submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: fmt.Sprintf("posts/val%02d", i), Int: int64(i)}))
+	}
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/last", Str: "last"}))
+
+	// Having fallen behind, it resets its client and resends its state
+	didReset := false
+	for _, node := range readSubUntil(t, sub, "posts/last") {
+		if node.Op == NodeOp_NodeRemoveAll && node.Keypath == "posts" {
+			didReset = true
+		}
+	}
+	if didReset == false {
+		t.Fatal("expected sub to resync")
+	}
+}
+
+func TestCoalescedSyncSteps(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	sub := openTestSub(t, A, alice, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:         "posts",
+			Scope:           KeypathScope_Shallow,
+			MaintainSync:    true,
+			SyncWindowMs:    1000,
+			CoalesceUpdates: true,
+		},
+	})
+	readSubUntil(t, sub, "posts/hello")
+
+	// Changes within the sync window are sent as one step, with only the latest update to each keypath
+	for i := 0; i < 5; i++ {
+		submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/val", Str: fmt.Sprint(i)}))
+	}
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/other", Str: "other"}))
+
+	var step []*Node
+	timeout := time.After(testTimeout)
+	for done := false; done == false; {
+		select {
+		case node := <-sub.Outbox():
+			switch node.Op {
+			case NodeOp_NodeUpdate:
+				step = append(step, node)
+			case NodeOp_SyncStep:
+				done = true
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for sync step")
+		}
+	}
+	if len(step) != 2 || step[0].Keypath != "posts/val" || step[0].Str != "4" || step[1].Keypath != "posts/other" {
+		t.Fatalf("expected posts/val (4) and posts/other, got %q", joinKeypaths(step))
+	}
+}
+
+func TestDomainSub(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uriA, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	uriB, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	sub, err := A.OpenDomainSub(&ChReq{
+		ChStateURI: &ChStateURI{DomainName: testDomain},
+		GetOp: &GetOp{
+			Keypath: "posts",
+			Scope:   KeypathScope_Shallow,
+		},
+	}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// Changes to any channel are sent (tagged with their channel), each commit followed by a SyncStep
+	submitTestTx(t, A, signTestTx(t, alice, uriA, &Node{Keypath: "posts/a", Str: "a"}))
+	submitTestTx(t, A, signTestTx(t, alice, uriB, &Node{Keypath: "other/x", Str: "x"}, &Node{Keypath: "posts/b", Str: "b"}))
+
+	var updates []*Node
+	steps := 0
+	for _, node := range readSubUntil(t, sub, "posts/b") {
+		if node.Op == NodeOp_NodeUpdate {
+			updates = append(updates, node)
+		} else if node.Op == NodeOp_SyncStep {
+			steps++
+		}
+	}
+	if len(updates) != 2 || updates[0].ChID != uriA.ChID || updates[1].ChID != uriB.ChID || steps != 1 {
+		t.Fatalf("expected posts/a in %v then posts/b in %v, got %q after %d steps", uriA.ChID, uriB.ChID, joinKeypaths(updates), steps)
+	}
+}
+
+func TestDomainSubReadAccess(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+	bob := newTestMember(t, A, "bob")
+
+	uriA, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	uriB, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	grantTestRights(t, A, alice, uriA, bob, ReadAccess)
+
+	chReq := &ChReq{
+		ChStateURI: &ChStateURI{DomainName: testDomain},
+		GetOp: &GetOp{
+			Keypath: "posts",
+			Scope:   KeypathScope_Shallow,
+		},
+	}
+	if _, err := A.OpenDomainSub(chReq, nil); toReqErr(err) == nil || toReqErr(err).Code != ErrCode_AccessDenied {
+		t.Fatalf("expected access denied, got %v", err)
+	}
+	sub, err := A.OpenDomainSub(chReq, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// Only changes to channels the reader can read are sent
+	submitTestTx(t, A, signTestTx(t, alice, uriB, &Node{Keypath: "posts/b1", Str: "b1"}))
+	submitTestTx(t, A, signTestTx(t, alice, uriA, &Node{Keypath: "posts/a1", Str: "a1"}))
+	expectUpdates := func(keypath string) {
+		t.Helper()
+		var updates []*Node
+		for _, node := range readSubUntil(t, sub, keypath) {
+			if node.Op == NodeOp_NodeUpdate {
+				updates = append(updates, node)
+			}
+		}
+		if got := joinKeypaths(updates); got != keypath {
+			t.Fatalf("expected only %v, got %q", keypath, got)
+		}
+	}
+	expectUpdates("posts/a1")
+
+	// ...as his rights change
+	grantTestRights(t, A, alice, uriA, bob, 0)
+	submitTestTx(t, A, signTestTx(t, alice, uriA, &Node{Keypath: "posts/a2", Str: "a2"}))
+	grantTestRights(t, A, alice, uriB, bob, ReadAccess)
+	submitTestTx(t, A, signTestTx(t, alice, uriB, &Node{Keypath: "posts/b2", Str: "b2"}))
+	expectUpdates("posts/b2")
+}
+
+func TestDomainSubFallsBehind(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	sub, err := A.OpenDomainSub(&ChReq{
+		ChStateURI: &ChStateURI{DomainName: testDomain},
+		GetOp: &GetOp{
+			Keypath: "posts",
+			Scope:   KeypathScope_Shallow,
+		},
+	}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// A sub that isn't read doesn't hold up merging, and is stopped once it falls behind
+	for i := 0; i < 2*domainSubBacklog; i++ {
+		submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: fmt.Sprintf("posts/val%03d", i), Int: int64(i)}))
+	}
+	timeout := time.After(testTimeout)
+	for open := true; open; {
+		select {
+		case _, open = <-sub.Outbox():
+		case <-timeout:
+			t.Fatal("timed out waiting for sub to stop")
+		}
+	}
+	if reason := sub.Ctx().CtxStopReason(); reason != domainSubFellBehind {
+		t.Fatalf("expected sub to fall behind, got %q", reason)
+	}
+}
+
+// openTestSub opens a sub for the given ChReq that is closed when the test completes.
+func openTestSub(t *testing.T, host Host, reader MemberSession, chReq *ChReq) ChSub {
+	sub, err := host.OpenChSub(chReq, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sub.Close)
+	return sub
+}
+
+// readSubUntil returns the nodes sent by the given sub up to and including the NodeUpdate for the given keypath.
+func readSubUntil(t *testing.T, sub ChSub, keypath string) []*Node {
+	var nodes []*Node
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case node, ok := <-sub.Outbox():
+			if !ok {
+				t.Fatalf("sub closed before %v was seen", keypath)
+			}
+			nodes = append(nodes, node)
+			if node.Op == NodeOp_NodeUpdate && node.Keypath == keypath {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", keypath)
+		}
+	}
+}
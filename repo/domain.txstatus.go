@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"github.com/plan-systems/plan-go/bufs"
+	"github.com/plan-systems/plan-go/device"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// txStatusKeypath is the reserved keypath (under a domain's keyspace) where the outcome of each merged or rejected tx is stored, keyed by TID.
+const txStatusKeypath = "/.txstatus/"
+
+// txStatusKey returns the db key of the status entry for the given TID.
+func (d *domain) txStatusKey(tid TID) []byte {
+	key := make([]byte, 0, len(d.keyPrefix)+len(txStatusKeypath)+len(tid))
+	return append(append(append(key, d.keyPrefix...), txStatusKeypath...), tid...)
+}
+
+// GetTxStatus returns the status of the tx with the given TID in this domain.
+//
+// A tx is pending while it is in this domain's pipeline and is unknown if it has never been received (or was received but not yet merged before a restart).
+func (d *domain) GetTxStatus(tid TID) (*TxStatus, error) {
+	if len(tid) != TIDSz {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("invalid TID")
+	}
+
+	status := &TxStatus{
+		TID: tid,
+	}
+
+	d.pendingTxsMu.Lock()
+	_, isPending := d.pendingTxs[string(tid)]
+	d.pendingTxsMu.Unlock()
+	if isPending {
+		status.State = TxState_Pending
+		return status, nil
+	}
+
+	err := d.stateDB.View(func(dbTx *badger.Txn) error {
+		stored, err := readTxStatus(dbTx, d.txStatusKey(tid))
+		if stored != nil {
+			status = stored
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// setTxStatus writes the status of the given TID (within the given db txn).
+// Since a merged tx remains merged, a tx already recorded as merged is left as is.
+func (d *domain) setTxStatus(dbTx *badger.Txn, tid TID, state TxState, reason error) error {
+	key := d.txStatusKey(tid)
+
+	prev, err := readTxStatus(dbTx, key)
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev.State == TxState_Merged {
+		return nil
+	}
+
+	status := &TxStatus{
+		TID:    tid,
+		State:  state,
+		TimeFS: int64(device.TimeNowFS()),
+	}
+	if reason != nil {
+		status.Err = toReqErr(reason)
+	}
+
+	return dbTx.Set(key, bufs.SmartMarshal(status, nil))
+}
+
+// readTxStatus returns the TxStatus stored at the given key (or nil if none is stored).
+func readTxStatus(dbTx *badger.Txn, key []byte) (*TxStatus, error) {
+	item, err := dbTx.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TxStatus{}
+	err = item.Value(func(val []byte) error {
+		return status.Unmarshal(val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,61 @@
+package repo
+
+import (
+	"testing"
+)
+
+func TestGetTxStatus(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+	bob := newTestMember(t, A, "bob")
+
+	uri, genesis := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	expectTxState(t, A, genesis, TxState_Merged, ErrCode_NoErr)
+
+	// A tx is pending until it is merged
+	d, err := A.(*host).holdDomain(testDomain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.(*host).releaseDomain(d)
+
+	tx := signTestTx(t, alice, uri, &Node{Keypath: "posts/pending", Str: "pending"})
+	expectTxState(t, A, tx, TxState_Unknown, ErrCode_NoErr)
+	d.commitMu.Lock()
+	txDone, err := A.SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTxState(t, A, tx, TxState_Pending, ErrCode_NoErr)
+	d.commitMu.Unlock()
+	if err = waitForTx(t, txDone); err != nil {
+		t.Fatal(err)
+	}
+	expectTxState(t, A, tx, TxState_Merged, ErrCode_NoErr)
+
+	// A rejected tx keeps the reason it was rejected
+	denied := signTestTx(t, bob, uri, &Node{Keypath: "posts/denied", Str: "denied"})
+	txDone, err = A.SubmitTx(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForTx(t, txDone)
+	expectTxState(t, A, denied, TxState_Rejected, ErrCode_AccessDenied)
+}
+
+// expectTxState checks the status the given host reports for the given tx.
+func expectTxState(t *testing.T, host Host, tx *Tx, state TxState, code ErrCode) {
+	t.Helper()
+
+	status, err := host.GetTxStatus(testDomain, tx.TID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCode := ErrCode_NoErr
+	if status.Err != nil {
+		errCode = status.Err.Code
+	}
+	if status.State != state || errCode != code {
+		t.Fatalf("expected tx %v to be %v (%v), got %v (%v)", TID(tx.TID).SuffixStr(), state, code, status.State, errCode)
+	}
+}
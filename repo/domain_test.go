@@ -0,0 +1,912 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/plan-systems/plan-go/bufs"
+	"github.com/plan-systems/plan-go/device"
+	"github.com/plan-systems/plan-go/ski"
+)
+
+const testDomain = "test-domain"
+
+func TestLateGenesisKeepsACL(t *testing.T) {
+	A := startTestHost(t)
+	B := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, genesis := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	aliceACL := ACLKeypath + "/" + bufs.Base32Encoding.EncodeToString(testSigner(t, genesis))
+
+	// Alice demotes herself, and B receives the demotion ahead of her genesis tx
+	demotion := signTestTx(t, alice, uri, &Node{Keypath: aliceACL, Int: int64(WriteAccess)})
+	submitTestTx(t, A, demotion)
+	demoted, err := B.ReceiveTx(&VaultTx{DomainName: testDomain, RawTx: demotion.RawTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := B.(*host).holdDomain(testDomain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer B.(*host).releaseDomain(d)
+	timeout := time.After(testTimeout)
+	for awaiting := 0; awaiting == 0; {
+		d.awaitingMu.Lock()
+		awaiting = len(d.awaitingGenesis)
+		d.awaitingMu.Unlock()
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out waiting for the demotion to await the genesis")
+		}
+	}
+	expectTxState(t, B, demotion, TxState_Pending, ErrCode_NoErr)
+
+	// Once the genesis arrives, the demotion is merged after it
+	created, err := B.ReceiveTx(&VaultTx{DomainName: testDomain, RawTx: genesis.RawTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = waitForTx(t, created); err != nil {
+		t.Fatal(err)
+	}
+	if err = waitForTx(t, demoted); err != nil {
+		t.Fatal(err)
+	}
+
+	// The late genesis grant must not restore her admin rights
+	promotion := signTestTx(t, alice, uri, &Node{Keypath: aliceACL, Int: int64(AllAccess)})
+	promoted, err := B.ReceiveTx(&VaultTx{DomainName: testDomain, RawTx: promotion.RawTx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqErr := toReqErr(waitForTx(t, promoted)); reqErr == nil || reqErr.Code != ErrCode_AccessDenied {
+		t.Fatalf("expected access denied, got %v", reqErr)
+	}
+}
+
+func TestReadAccess(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+	bob := newTestMember(t, A, "bob")
+
+	uri, genesis := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	expectDenied := func(err error) {
+		t.Helper()
+		if reqErr := toReqErr(err); reqErr == nil || reqErr.Code != ErrCode_AccessDenied {
+			t.Fatalf("expected access denied, got %v", reqErr)
+		}
+	}
+	getOp := func(asOfTID TID, maintainSync bool) *ChReq {
+		return &ChReq{
+			ChStateURI: uri,
+			GetOp: &GetOp{
+				Keypath:      "posts",
+				Scope:        KeypathScope_Shallow,
+				AsOfTID:      asOfTID,
+				MaintainSync: maintainSync,
+			},
+		}
+	}
+
+	// Without ReadAccess, a member can't read the channel's state (current or past) or its tx log
+	_, err := A.OpenChSub(getOp(nil, false), bob)
+	expectDenied(err)
+	_, err = A.OpenChSub(getOp(genesis.TID, false), bob)
+	expectDenied(err)
+	_, err = A.OpenChTxFeed(uri, nil, false, bob)
+	expectDenied(err)
+	_, err = A.OpenChSub(getOp(nil, false), nil)
+	expectDenied(err)
+
+	// Once granted ReadAccess, he can
+	grantTestRights(t, A, alice, uri, bob, ReadAccess)
+	if got := readEntryStr(t, A, bob, uri, "posts/hello"); got != "hello" {
+		t.Fatalf("expected posts/hello to be read, got %q", got)
+	}
+	if nodes := readNodes(t, A, bob, getOp(genesis.TID, false)); len(nodes) != 1 {
+		t.Fatalf("expected 1 node as of genesis, got %q", joinKeypaths(nodes))
+	}
+	sub := openTestSub(t, A, bob, getOp(nil, true))
+	readSubUntil(t, sub, "posts/hello")
+	feed, err := A.OpenChTxFeed(uri, nil, true, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+	timeout := time.After(testTimeout)
+	for sent := 0; sent < 2; sent++ {
+		select {
+		case <-feed.Outbox():
+		case <-timeout:
+			t.Fatal("timed out waiting for the genesis and grant")
+		}
+	}
+
+	// Revoking his ReadAccess ends his sub and feed, and nothing merged from then on is sent to him
+	grantTestRights(t, A, alice, uri, bob, 0)
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/secret", Str: "secret"}))
+	for open := true; open; {
+		select {
+		case node, ok := <-sub.Outbox():
+			if ok && node.Keypath == "posts/secret" {
+				t.Fatal("change sent after read access was revoked")
+			}
+			open = ok
+		case <-timeout:
+			t.Fatal("timed out waiting for sub to stop")
+		}
+	}
+	if reason := sub.Ctx().CtxStopReason(); reason != readAccessRevoked {
+		t.Fatalf("expected sub to stop for revoked access, got %q", reason)
+	}
+	for open := true; open; {
+		select {
+		case _, open = <-feed.Outbox():
+			if open {
+				t.Fatal("tx sent after read access was revoked")
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for feed to stop")
+		}
+	}
+	if reason := feed.Ctx().CtxStopReason(); reason != readAccessRevoked {
+		t.Fatalf("expected feed to stop for revoked access, got %q", reason)
+	}
+}
+
+func TestMergeIsIdempotent(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, genesis := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	tx := signTestTx(t, alice, uri, &Node{Keypath: "posts/again", Str: "hello again"})
+	submitTestTx(t, A, tx)
+
+	// Merging the same tx again completes without error but merges nothing
+	submitTestTx(t, A, tx)
+	next := signTestTx(t, alice, uri, &Node{Keypath: "posts/next", Str: "next"})
+	submitTestTx(t, A, next)
+
+	feed, err := A.OpenTxFeed(testDomain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	for i, expect := range []*Tx{genesis, tx, next} {
+		select {
+		case vtx := <-feed.Outbox():
+			if bytes.Equal(vtx.RawTx.TID, expect.TID) == false || vtx.MergeSeq != uint64(i+1) {
+				t.Fatalf("expected tx %v at merge seq %d, got %v at %d", TID(expect.TID).SuffixStr(), i+1, TID(vtx.RawTx.TID).SuffixStr(), vtx.MergeSeq)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for tx feed")
+		}
+	}
+}
+
+func TestConcurrentUpdatesResolveByLWW(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	revID := int64(device.TimeNowFS())
+
+	// An older revision merged after a newer one is dropped
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/val", Str: "newer", RevID: revID + 10}))
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/val", Str: "older", RevID: revID}))
+	if got := readEntryStr(t, A, alice, uri, "posts/val"); got != "newer" {
+		t.Fatalf("expected newer revision to win, got %q", got)
+	}
+
+	// Revisions with the same RevID are ordered by TID, regardless of merge order
+	first := signTestTx(t, alice, uri, &Node{Keypath: "posts/tie", Str: "first", RevID: revID + 20})
+	second := signTestTx(t, alice, uri, &Node{Keypath: "posts/tie", Str: "second", RevID: revID + 20})
+	expect := "second"
+	if bytes.Compare(first.TID, second.TID) > 0 {
+		expect = "first"
+	}
+	submitTestTx(t, A, second)
+	submitTestTx(t, A, first)
+	if got := readEntryStr(t, A, alice, uri, "posts/tie"); got != expect {
+		t.Fatalf("expected %q to win the tie, got %q", expect, got)
+	}
+}
+
+func TestRemovalsLeaveTombstones(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	revID := int64(device.TimeNowFS())
+	write := func(keypath, str string, rev int64) {
+		submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: keypath, Str: str, RevID: revID + rev}))
+	}
+	remove := func(op NodeOp, keypath string, rev int64) {
+		submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Op: op, Keypath: keypath, RevID: revID + rev}))
+	}
+
+	// An update older than a removal is dropped, while a newer one restores the node
+	write("posts/val", "val", 10)
+	remove(NodeOp_NodeRemove, "posts/val", 20)
+	write("posts/val", "late", 15)
+	if got := readEntryStr(t, A, alice, uri, "posts/val"); got != "" {
+		t.Fatalf("expected removed node, got %q", got)
+	}
+	write("posts/val", "restored", 30)
+	if got := readEntryStr(t, A, alice, uri, "posts/val"); got != "restored" {
+		t.Fatalf("expected restored node, got %q", got)
+	}
+
+	// Removing a subtree drops older writes under it (even those merged later)
+	write("posts/dir/kept", "kept", 5)
+	remove(NodeOp_NodeRemoveAll, "posts/dir", 40)
+	write("posts/dir/late", "late", 35)
+	write("posts/dir/newer", "newer", 50)
+	var keypaths []string
+	for _, node := range readState(t, A, alice, uri, "posts/dir") {
+		keypaths = append(keypaths, node.Keypath)
+	}
+	if len(keypaths) != 1 || keypaths[0] != "posts/dir/newer" {
+		t.Fatalf("expected only posts/dir/newer, got %v", keypaths)
+	}
+}
+
+func TestParallelMerging(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	const numChs = 4
+	const txsPerCh = 50
+	var uris []*ChStateURI
+	for i := 0; i < numChs; i++ {
+		uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+		uris = append(uris, uri)
+	}
+
+	// Submit without waiting so that each channel's merge worker commits txns in batches alongside the others
+	var pending []TxCompletion
+	for j := 0; j < txsPerCh; j++ {
+		for _, uri := range uris {
+			txDone, err := A.SubmitTx(signTestTx(t, alice, uri, &Node{Keypath: fmt.Sprintf("posts/val%02d", j), Int: int64(j)}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending = append(pending, txDone)
+		}
+	}
+	for _, txDone := range pending {
+		if err := waitForTx(t, txDone); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, uri := range uris {
+		if nodes := readState(t, A, alice, uri, "posts"); len(nodes) != 1+txsPerCh {
+			t.Fatalf("expected %d nodes, got %d", 1+txsPerCh, len(nodes))
+		}
+	}
+
+	// Every tx is assigned its own merge seq
+	feed, err := A.OpenTxFeed(testDomain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+	for seq := uint64(1); seq <= numChs*(1+txsPerCh); seq++ {
+		select {
+		case vtx := <-feed.Outbox():
+			if vtx.MergeSeq != seq {
+				t.Fatalf("expected merge seq %d, got %d", seq, vtx.MergeSeq)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for tx feed")
+		}
+	}
+}
+
+func TestCommitsOverlap(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	uriB, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	d, err := A.(*host).holdDomain(testDomain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.(*host).releaseDomain(d)
+
+	// Stand in for a commit to the first channel that the db has yet to complete
+	inFlight := &pendingCommit{
+		delivered: make(chan struct{}),
+	}
+	d.commitMu.Lock()
+	d.commits = append(d.commits, inFlight)
+	d.commitMu.Unlock()
+
+	// A commit to another channel isn't held up by it...
+	tx := signTestTx(t, alice, uriB, &Node{Keypath: "posts/b", Str: "b"})
+	txDone, err := A.SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(testTimeout)
+	for {
+		if _, err = d.readVersion(d.txLogKey(tx.TID)); err == nil {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for commit")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// ...but it is only delivered (and completed) after the commit before it
+	select {
+	case <-txDone.Done():
+		t.Fatal("expected tx to be delivered in commit order")
+	case <-time.After(50 * time.Millisecond):
+	}
+	d.finishCommit(inFlight, nil)
+	if err = waitForTx(t, txDone); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyEncodingIsolatesSiblings(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	// Keypaths sharing a string prefix aren't under each other, and single character components are allowed
+	uri, _ := newTestChannel(t, A, alice,
+		&Node{Keypath: "a", Str: "a"},
+		&Node{Keypath: "a/b", Str: "a/b"},
+		&Node{Keypath: "a/b/c", Str: "a/b/c"},
+		&Node{Keypath: "ab/c", Str: "ab/c"},
+	)
+
+	tests := []struct {
+		keypath string
+		scope   KeypathScope
+		expect  string
+	}{
+		{"a", KeypathScope_EntryAtKeypath, "a"},
+		{"a", KeypathScope_Shallow, "a/b"},
+		{"a", KeypathScope_ShallowAndDeep, "a/b a/b/c"},
+		{"ab", KeypathScope_ShallowAndDeep, "ab/c"},
+	}
+	for _, test := range tests {
+		nodes := readNodes(t, A, alice, &ChReq{
+			ChStateURI: uri,
+			GetOp: &GetOp{
+				Keypath: test.keypath,
+				Scope:   test.scope,
+			},
+		})
+		if got := joinKeypaths(nodes); got != test.expect {
+			t.Errorf("%q (%v): expected %q, got %q", test.keypath, test.scope, test.expect, got)
+		}
+	}
+}
+
+func TestMultiChCommitOrder(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uriA, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	uriB, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/val", Str: "start"})
+
+	sub, err := A.OpenChSub(&ChReq{
+		ChStateURI: uriB,
+		GetOp: &GetOp{
+			Keypath:      "posts",
+			Scope:        KeypathScope_Shallow,
+			MaintainSync: true,
+		},
+	}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// Alternate between writing to B directly and via a multi-channel tx merged by A's worker
+	const numTxs = 60
+	revID := int64(device.TimeNowFS())
+	var pending []TxCompletion
+	for i := 0; i < numTxs; i++ {
+		entry := &Node{Keypath: "posts/val", Str: fmt.Sprint(i), RevID: revID + int64(i)}
+		var tx *Tx
+		if i%2 == 0 {
+			tx, err = alice.EncodeToTxAndSign(&TxOp{
+				ChStateURI: uriA,
+				Entries:    []*Node{{Keypath: "posts/count", Int: int64(i)}},
+				ChEntries:  []*ChEntries{{ChID: uriB.ChID, ChID_TID: uriB.ChID_TID, Entries: []*Node{entry}}},
+			})
+		} else {
+			tx, err = alice.EncodeToTxAndSign(&TxOp{ChStateURI: uriB, Entries: []*Node{entry}})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		txDone, err := A.SubmitTx(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, txDone)
+	}
+	for _, txDone := range pending {
+		if err = waitForTx(t, txDone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	submitTestTx(t, A, signTestTx(t, alice, uriB, &Node{Keypath: "posts/last", Str: "last"}))
+
+	// Commits are seen in commit order, so once the final tx is seen, the latest value of val seen must be the newest revision
+	latest := ""
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case node := <-sub.Outbox():
+			if node.Op != NodeOp_NodeUpdate {
+				continue
+			}
+			if node.Keypath == "posts/val" {
+				latest = node.Str
+			} else if node.Keypath == "posts/last" {
+				if latest != fmt.Sprint(numTxs-1) {
+					t.Fatalf("expected val to be %d, got %q", numTxs-1, latest)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for sub")
+		}
+	}
+}
+
+func TestPreconditionsCheckedByAuthor(t *testing.T) {
+	hub := NewLoopbackHub()
+	A := startTestHost(t, hub.NewVault())
+	B := startTestHost(t, hub.NewVault())
+	alice := newTestMember(t, A, "alice")
+
+	bob := newTestMember(t, B, "bob")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	waitForMerge(t, B, grantTestRights(t, A, alice, uri, bob, ReadAccess))
+
+	sub, err := B.OpenChSub(&ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:      "posts",
+			Scope:        KeypathScope_Shallow,
+			MaintainSync: true,
+		},
+	}, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// A tx whose precondition fails where it is authored is rejected there and is not published
+	clobber := signTestTx(t, alice, uri, &Node{Keypath: "posts/hello", Str: "clobbered", Precondition: Precondition_MustNotExist})
+	txDone, err := A.SubmitTx(clobber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqErr := toReqErr(waitForTx(t, txDone)); reqErr == nil || reqErr.Code != ErrCode_PreconditionFailed {
+		t.Fatalf("expected precondition failure, got %v", reqErr)
+	}
+	submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/next", Str: "next"}))
+
+	timeout := time.After(testTimeout)
+	for next := false; next == false; {
+		select {
+		case node := <-sub.Outbox():
+			if node.Op == NodeOp_NodeUpdate && node.Str == "clobbered" {
+				t.Fatal("rejected tx was replicated")
+			}
+			next = node.Keypath == "posts/next"
+		case <-timeout:
+			t.Fatal("timed out waiting for replica")
+		}
+	}
+
+	// A replica merges a tx received from elsewhere without checking its preconditions
+	txDone, err = B.ReceiveTx(&VaultTx{DomainName: testDomain, RawTx: clobber.RawTx})
+	if err == nil {
+		err = waitForTx(t, txDone)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range readState(t, B, bob, uri, "posts") {
+		if node.Keypath == "posts/hello" && node.Str != "clobbered" {
+			t.Fatalf("expected replica to merge tx, got %q", node.Str)
+		}
+	}
+}
+
+func TestChEntriesRequireExistingCh(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	// A tx that also writes to a channel that was never created is rejected as a whole
+	unknownTID := make([]byte, Const_TIDSz)
+	unknownTID[len(unknownTID)-1] = 1
+	tx, err := alice.EncodeToTxAndSign(&TxOp{
+		ChStateURI: uri,
+		Entries:    []*Node{{Keypath: "posts/added", Str: "added"}},
+		ChEntries:  []*ChEntries{{ChID_TID: unknownTID, Entries: []*Node{{Keypath: "posts/val", Str: "val"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txDone, err := A.SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqErr := toReqErr(waitForTx(t, txDone)); reqErr == nil || reqErr.Code != ErrCode_InvalidURI {
+		t.Fatalf("expected invalid URI, got %v", reqErr)
+	}
+	for _, node := range readState(t, A, alice, uri, "posts") {
+		if node.Keypath == "posts/added" {
+			t.Fatal("rejected tx was partially merged")
+		}
+	}
+}
+
+func TestChEntriesOnlyTx(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uriA, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	uriB, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	// A tx can write only to its other channels
+	tx, err := alice.EncodeToTxAndSign(&TxOp{
+		ChStateURI: uriA,
+		ChEntries:  []*ChEntries{{ChID_TID: uriB.ChID_TID, Entries: []*Node{{Keypath: "posts/b", Str: "b"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitTestTx(t, A, tx)
+	if got := readEntryStr(t, A, alice, uriB, "posts/b"); got != "b" {
+		t.Fatalf("expected posts/b to be written, got %q", got)
+	}
+
+	// A tx with no entries in any channel is refused
+	_, err = alice.EncodeToTxAndSign(&TxOp{
+		ChStateURI: uriA,
+		ChEntries:  []*ChEntries{{ChID_TID: uriB.ChID_TID}},
+	})
+	if reqErr := toReqErr(err); reqErr == nil || reqErr.Code != ErrCode_NothingToCommit {
+		t.Fatalf("expected nothing to commit, got %v", reqErr)
+	}
+}
+
+func TestRejectedTxsQuarantined(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	// A signed payload with a header this repo doesn't recognize
+	malformed := signTestTx(t, alice, uri, &Node{Keypath: "posts/malformed", Str: "malformed"})
+	{
+		ms := alice.(*membSess)
+		body, err := malformed.TxOp.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var packed ski.PackingInfo
+		if err = ms.packer.PackAndSign(TxHeaderCodec+1, make([]byte, TxHeaderSz), body, 0, &packed); err != nil {
+			t.Fatal(err)
+		}
+		malformed.RawTx = &RawTx{
+			TID:   make([]byte, TIDSz),
+			Bytes: packed.SignedBuf,
+		}
+		TID(malformed.RawTx.TID).SetTimeAndHash(TID(malformed.TID).ExtractTimeFS(), packed.Hash)
+		malformed.TID = malformed.RawTx.TID
+	}
+
+	// A tx whose signature no longer matches its payload
+	tamperedSig := signTestTx(t, alice, uri, &Node{Keypath: "posts/sig", Str: "sig"})
+	tamperedSig.RawTx.Bytes[len(tamperedSig.RawTx.Bytes)-1] ^= 0xFF
+
+	// A tx whose TID was altered after it was signed
+	tamperedTID := signTestTx(t, alice, uri, &Node{Keypath: "posts/tid", Str: "tid"})
+	tamperedTID.RawTx.TID[TIDSz-1] ^= 0xFF
+	tamperedTID.TID = tamperedTID.RawTx.TID
+
+	d, err := A.(*host).holdDomain(testDomain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.(*host).releaseDomain(d)
+
+	tests := []struct {
+		name string
+		tx   *Tx
+		code ErrCode
+	}{
+		{"malformed header", malformed, ErrCode_TxMalformed},
+		{"tampered signature", tamperedSig, ErrCode_TxSigInvalid},
+		{"TID mismatch", tamperedTID, ErrCode_TIDMismatch},
+	}
+	for _, test := range tests {
+		txDone, err := A.SubmitTx(test.tx)
+		if err == nil {
+			err = waitForTx(t, txDone)
+		}
+		if reqErr := toReqErr(err); reqErr == nil || reqErr.Code != test.code {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.code, reqErr)
+		}
+		expectTxState(t, A, test.tx, TxState_Rejected, test.code)
+
+		qtx := readQuarantinedTx(t, d, test.tx.TID)
+		if qtx == nil {
+			t.Fatalf("%s: expected tx to be quarantined", test.name)
+		}
+		if qtx.Err == nil || qtx.Err.Code != test.code || bytes.Equal(qtx.RawTx.Bytes, test.tx.RawTx.Bytes) == false {
+			t.Fatalf("%s: expected the rejected tx to be quarantined with %v, got %v", test.name, test.code, qtx.Err)
+		}
+	}
+
+	// A valid tx still merges (and isn't quarantined)
+	valid := signTestTx(t, alice, uri, &Node{Keypath: "posts/valid", Str: "valid"})
+	submitTestTx(t, A, valid)
+	if got := readEntryStr(t, A, alice, uri, "posts/valid"); got != "valid" {
+		t.Fatalf("expected posts/valid to be written, got %q", got)
+	}
+	if readQuarantinedTx(t, d, valid.TID) != nil {
+		t.Fatal("valid tx was quarantined")
+	}
+	for _, keypath := range []string{"posts/malformed", "posts/sig", "posts/tid"} {
+		if got := readEntryStr(t, A, alice, uri, keypath); got != "" {
+			t.Fatalf("rejected tx wrote %v", keypath)
+		}
+	}
+}
+
+// readQuarantinedTx returns the tx the given domain quarantined under the given TID (or nil if there is none).
+func readQuarantinedTx(t *testing.T, d *domain, tid TID) *QuarantinedTx {
+	key := append(append(append([]byte{}, d.keyPrefix...), quarantineKeypath...), tid...)
+
+	var qtx *QuarantinedTx
+	err := d.stateDB.View(func(dbTx *badger.Txn) error {
+		item, err := dbTx.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			qtx = &QuarantinedTx{}
+			return qtx.Unmarshal(val)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return qtx
+}
+
+func TestSubmitToRenamedDomain(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	// A caller still holding a domain that is stopped by a rename sees its tx canceled
+	d, err := A.(*host).holdDomain(testDomain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.(*host).releaseDomain(d)
+	if err = A.RenameDomain(testDomain, "renamed-domain"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := signTestTx(t, alice, uri, &Node{Keypath: "posts/after", Str: "after"})
+	txDone, err := d.SubmitTx(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqErr := toReqErr(waitForTx(t, txDone)); reqErr == nil || reqErr.Code != ErrCode_ReqCanceled {
+		t.Fatalf("expected tx to be canceled, got %v", reqErr)
+	}
+
+	// The domain is remounted under its new name, where the tx then merges
+	submitTestTx(t, A, tx)
+	if nodes := readState(t, A, alice, uri, "posts"); len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(nodes))
+	}
+}
+
+func TestGetOpPaging(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	var entries []*Node
+	for i := 0; i < 10; i++ {
+		entries = append(entries, &Node{Keypath: fmt.Sprintf("posts/k%02d", i), Str: fmt.Sprint(i)})
+	}
+	uri, _ := newTestChannel(t, A, alice, entries...)
+
+	tests := []struct {
+		startAfter string
+		maxNodes   int32
+		reverse    bool
+		expect     string
+		cont       string
+	}{
+		{"", 4, false, "posts/k00 posts/k01 posts/k02 posts/k03", "posts/k03"},
+		{"posts/k03", 4, false, "posts/k04 posts/k05 posts/k06 posts/k07", "posts/k07"},
+		{"posts/k07", 4, false, "posts/k08 posts/k09", ""},
+		{"", 3, true, "posts/k09 posts/k08 posts/k07", "posts/k07"},
+		{"posts/k02", 0, true, "posts/k01 posts/k00", ""},
+	}
+	for _, test := range tests {
+		nodes, cont := readTestPage(t, A, alice, &ChReq{
+			ChStateURI: uri,
+			GetOp: &GetOp{
+				Keypath:    "posts",
+				Scope:      KeypathScope_Shallow,
+				StartAfter: test.startAfter,
+				MaxNodes:   test.maxNodes,
+				Reverse:    test.reverse,
+			},
+		})
+		if got := joinKeypaths(nodes); got != test.expect || cont != test.cont {
+			t.Errorf("after %q (max %d, reverse %v): expected %q (continue after %q), got %q (continue after %q)",
+				test.startAfter, test.maxNodes, test.reverse, test.expect, test.cont, got, cont)
+		}
+	}
+
+	// A keys only read sends no values
+	nodes, _ := readTestPage(t, A, alice, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:  "posts",
+			Scope:    KeypathScope_Shallow,
+			KeysOnly: true,
+		},
+	})
+	if len(nodes) != len(entries) {
+		t.Fatalf("expected %d keys, got %d", len(entries), len(nodes))
+	}
+	for _, node := range nodes {
+		if len(node.Str) > 0 {
+			t.Fatalf("expected no value for %v, got %q", node.Keypath, node.Str)
+		}
+	}
+
+	// A paged read can't maintain sync, since changes beyond the page sent would follow
+	_, err := A.OpenChSub(&ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath:      "posts",
+			Scope:        KeypathScope_Shallow,
+			MaxNodes:     4,
+			MaintainSync: true,
+		},
+	}, alice)
+	if reqErr := toReqErr(err); reqErr == nil || reqErr.Code != ErrCode_UnsupporteReqOp {
+		t.Fatalf("expected a paged sub to be refused, got %v", reqErr)
+	}
+}
+
+// newTestChannel creates a channel on the given host (authored by the given member) holding the given entries.
+func newTestChannel(t *testing.T, host Host, ms MemberSession, entries ...*Node) (*ChStateURI, *Tx) {
+	genesis, err := ms.EncodeToTxAndSign(&TxOp{
+		ChStateURI: &ChStateURI{
+			DomainName: testDomain,
+		},
+		ChannelGenesis: true,
+		Entries:        entries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitTestTx(t, host, genesis)
+
+	uri := genesis.TxOp.ChStateURI
+	return &ChStateURI{
+		DomainName: uri.DomainName,
+		ChID:       uri.ChID,
+		ChID_TID:   uri.ChID_TID,
+	}, genesis
+}
+
+// signTestTx returns a tx (signed by the given member) that writes the given entries to the given channel.
+func signTestTx(t *testing.T, ms MemberSession, uri *ChStateURI, entries ...*Node) *Tx {
+	tx, err := ms.EncodeToTxAndSign(&TxOp{
+		ChStateURI: &ChStateURI{
+			DomainName: uri.DomainName,
+			ChID:       uri.ChID,
+			ChID_TID:   uri.ChID_TID,
+		},
+		Entries: entries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// grantTestRights submits (to the given host) a tx signed by the given admin that grants the given member the given rights to the given channel.
+func grantTestRights(t *testing.T, host Host, admin MemberSession, uri *ChStateURI, member MemberSession, rights ChRights) *Tx {
+	grant := signTestTx(t, admin, uri, &Node{Keypath: aclKeypathFor(member.PubKey()), Int: int64(rights)})
+	submitTestTx(t, host, grant)
+	return grant
+}
+
+// readTestPage returns the node updates sent for the given (state only) ChReq and the keypath to continue after (if any).
+func readTestPage(t *testing.T, host Host, reader MemberSession, chReq *ChReq) ([]*Node, string) {
+	sub, err := host.OpenChSub(chReq, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nodes []*Node
+	cont := ""
+	for node := range sub.Outbox() {
+		switch node.Op {
+		case NodeOp_NodeUpdate:
+			nodes = append(nodes, node)
+		case NodeOp_ChStateContinuation:
+			cont = node.Keypath
+		}
+	}
+	return nodes, cont
+}
+
+// readEntryStr returns the Str of the node at the given keypath (or "" if there is none).
+func readEntryStr(t *testing.T, host Host, reader MemberSession, uri *ChStateURI, keypath string) string {
+	nodes := readNodes(t, host, reader, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath: keypath,
+			Scope:   KeypathScope_EntryAtKeypath,
+		},
+	})
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0].Str
+}
+
+// joinKeypaths returns the keypaths of the given nodes (in order), joined by spaces.
+func joinKeypaths(nodes []*Node) string {
+	keypaths := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		keypaths = append(keypaths, node.Keypath)
+	}
+	return strings.Join(keypaths, " ")
+}
+
+// testSigner returns the pub key that signed the given tx.
+func testSigner(t *testing.T, tx *Tx) []byte {
+	unpacker := ski.NewUnpacker(false)
+	decoded, err := DecodeRawTx(tx.RawTx, &unpacker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded.Signer
+}
@@ -60,3 +60,16 @@ func (code ErrCode) Wrap(cause error) error {
 		Msg:  cause.Error(),
 	}
 }
+
+// toReqErr returns the given error as a ReqErr, wrapping it as ErrCode_UnnamedErr if it is not already a ReqErr.
+func toReqErr(err error) *ReqErr {
+	if err == nil {
+		return nil
+	}
+
+	var reqErr *ReqErr
+	if reqErr, _ = err.(*ReqErr); reqErr == nil {
+		reqErr = ErrCode_UnnamedErr.Wrap(err).(*ReqErr)
+	}
+	return reqErr
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"path"
-	"regexp"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -82,12 +81,13 @@ func (srv *GrpcServer) Start() error {
 }
 
 type reqJob struct {
-	req      *ChReq
-	sess     *repoSess
-	filters  nodeFilters
-	scrap    []byte
-	canceled bool
-	chSub    ChSub
+	req        *ChReq
+	sess       *repoSess
+	scrap      []byte
+	canceled   chan struct{} // closed once this job is canceled
+	cancelOnce sync.Once
+	chSub      ChSub
+	txFeed     TxFeed
 }
 
 // Debugf prints output to the output log
@@ -97,19 +97,29 @@ func (job *reqJob) Debugf(msgFormat string, msgArgs ...interface{}) {
 
 // canceled returns true if this job should back out of all work.
 func (job *reqJob) isCanceled() bool {
-	return job.canceled
+	select {
+	case <-job.canceled:
+		return true
+	default:
+		return false
+	}
 }
 
 func (job *reqJob) cancelJob() {
-	job.canceled = true
+	job.cancelOnce.Do(func() {
+		close(job.canceled)
+	})
 	if job.chSub != nil {
 		job.chSub.Close()
 	}
+	if job.txFeed != nil {
+		job.txFeed.Close()
+	}
 }
 
 func (job *reqJob) exeGetOp() error {
 	var err error
-	job.chSub, err = job.sess.srv.host.OpenChSub(job.req)
+	job.chSub, err = job.sess.srv.host.OpenChSub(job.req, job.sess.membSess)
 	if err != nil {
 		return err
 	}
@@ -123,29 +133,127 @@ func (job *reqJob) exeGetOp() error {
 		}
 	}
 
+	if job.chSub.Ctx().CtxStopReason() == readAccessRevoked {
+		return ErrCode_AccessDenied.ErrWithMsg(readAccessRevoked)
+	}
+
+	return nil
+}
+
+func (job *reqJob) exeDomainSub() error {
+	var err error
+	job.chSub, err = job.sess.srv.host.OpenDomainSub(job.req, job.sess.membSess)
+	if err != nil {
+		return err
+	}
+	defer job.chSub.Close()
+
+	for node := range job.chSub.Outbox() {
+		job.sess.nodeOutbox <- node
+	}
+
+	// Let the client know to reopen the sub if it was dropped for falling behind
+	if job.chSub.Ctx().CtxStopReason() == domainSubFellBehind {
+		return ErrCode_ReqCanceled.ErrWithMsg(domainSubFellBehind)
+	}
+
+	return nil
+}
+
+func (job *reqJob) exeListChannels() error {
+	var err error
+	job.chSub, err = job.sess.srv.host.OpenChDir(job.req)
+	if err != nil {
+		return err
+	}
+	defer job.chSub.Close()
+
+	for node := range job.chSub.Outbox() {
+		job.sess.nodeOutbox <- node
+	}
+
+	return nil
+}
+
+func (job *reqJob) exeAliasCh() error {
+	if job.req.ChStateURI == nil {
+		return ErrCode_InvalidURI.ErrWithMsg("no channel given")
+	}
+
+	return job.sess.srv.host.AliasCh(job.req.ChStateURI, job.req.ChAlias)
+}
+
+func (job *reqJob) exeTxLogOp() error {
+	var err error
+	job.txFeed, err = job.sess.srv.host.OpenChTxFeed(job.req.ChStateURI, job.req.TxLogOp.FromTID, job.req.TxLogOp.MaintainSync, job.sess.membSess)
+	if err != nil {
+		return err
+	}
+	defer job.txFeed.Close()
+
+	// Each tx is sent as the signed RawTx originally submitted, allowing the client to verify it
+	for vtx := range job.txFeed.Outbox() {
+		node := job.newResponse(NodeOp_ChTx)
+		node.Attachment = bufs.SmartMarshal(vtx.RawTx, node.Attachment)
+		job.sess.nodeOutbox <- node
+	}
+
+	if job.txFeed.Ctx().CtxStopReason() == readAccessRevoked {
+		return ErrCode_AccessDenied.ErrWithMsg(readAccessRevoked)
+	}
+
 	return nil
 }
 
+func (job *reqJob) exeGetTxStatus() (*Node, error) {
+	if job.req.ChStateURI == nil {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
+	status, err := job.sess.srv.host.GetTxStatus(job.req.ChStateURI.DomainName, job.req.TID)
+	if err != nil {
+		return nil, err
+	}
+
+	node := job.newResponse(NodeOp_ReqComplete)
+	node.Attachment = bufs.SmartMarshal(status, node.Attachment)
+	return node, nil
+}
+
 func (job *reqJob) exeTxOp() (*Node, error) {
 
 	if job.req.TxOp.ChStateURI == nil {
 		job.req.TxOp.ChStateURI = job.req.ChStateURI
 	}
+	if job.req.TxOp.ChStateURI == nil {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no channel URI given")
+	}
 
 	tx, err := job.sess.membSess.EncodeToTxAndSign(job.req.TxOp)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: don't release this op until its merged or rejected (required tx broadcast)
-	err = job.sess.srv.host.SubmitTx(tx)
+	txDone, err := job.sess.srv.host.SubmitTx(tx)
 	if err != nil {
 		return nil, err
 	}
 
+	// Don't complete this op until the tx is merged or rejected (or the req is canceled, which doesn't withdraw the tx)
+	select {
+	case <-txDone.Done():
+	case <-job.canceled:
+		return nil, ErrCode_ReqCanceled.ErrWithMsg("tx req canceled")
+	case <-job.sess.CtxStopping():
+		return nil, ErrCode_ReqCanceled.ErrWithMsg("repo session stopping")
+	}
+	if err = txDone.Err(); err != nil {
+		return nil, err
+	}
+
 	node := job.newResponse(NodeOp_ReqComplete)
 	node.Attachment = append(node.Attachment[:0], tx.TID...)
-	node.Str = path.Join(job.req.ChStateURI.DomainName, TID(tx.TID).Base32())
+	node.Str = path.Join(tx.TxOp.ChStateURI.DomainName, TID(tx.TID).Base32())
 
 	return node, nil
 }
@@ -173,12 +281,28 @@ func (job *reqJob) exeJob() {
 
 		case ChReqOp_Auto:
 			switch {
+			case job.req.EnclaveAccess != nil:
+				err = job.sess.membSess.ExpandAccess(job.req.EnclaveAccess)
 			case job.req.GetOp != nil:
 				err = job.exeGetOp()
+			case job.req.TxLogOp != nil:
+				err = job.exeTxLogOp()
 			case job.req.TxOp != nil:
 				node, err = job.exeTxOp()
 			}
 
+		case ChReqOp_GetTxStatus:
+			node, err = job.exeGetTxStatus()
+
+		case ChReqOp_DomainSub:
+			err = job.exeDomainSub()
+
+		case ChReqOp_ListChannels:
+			err = job.exeListChannels()
+
+		case ChReqOp_AliasCh:
+			err = job.exeAliasCh()
+
 		default:
 			err = ErrCode_UnsupporteReqOp.Err()
 		}
@@ -263,6 +387,7 @@ func (sess *repoSess) ctxStartup() error {
 
 func (sess *repoSess) ctxStopping() {
 	sess.cancelAll()
+	sess.membSess.EndSession("repo session stopping")
 }
 
 func (sess *repoSess) lookupJob(reqID int32) *reqJob {
@@ -290,8 +415,9 @@ func (sess *repoSess) numJobsOpen() int {
 
 func (sess *repoSess) addNewJob(reqIn *ChReq) *reqJob {
 	job := &reqJob{
-		req:  reqIn,
-		sess: sess,
+		req:      reqIn,
+		sess:     sess,
+		canceled: make(chan struct{}),
 	}
 
 	sess.openReqsMu.Lock()
@@ -383,9 +509,173 @@ func (srv *GrpcServer) RepoServiceSession(rpc RepoGrpc_RepoServiceSessionServer)
 	return nil
 }
 
-type nodeFilters struct {
-	regexKeypath *regexp.Regexp
-	regexTypeID  *regexp.Regexp
+// VaultSession serves a peer's Vault (see NewGrpcVault).
+// Each msg from the peer either requests a domain's tx feed (following a given merge seq) or pushes a signed tx to be merged.
+// Each pushed tx is acknowledged (in order) once merged, and is not sent back to the peer over this session.
+//
+// The session ends with an error if a feed stops early (e.g. it fell behind) or a pushed tx is dropped, so that the peer reconnects and resumes from its cursor.
+func (srv *GrpcServer) VaultSession(rpc RepoGrpc_VaultSessionServer) error {
+	vs := &vaultSess{
+		srv:    srv,
+		rpc:    rpc,
+		pushed: make(chan pendingVaultTx, vaultAckBacklog),
+		ended:  make(chan error, 1),
+	}
+
+	go vs.recvLoop()
+	go func() {
+		if err := ackInOrder(vs.pushed, vs.sendAck); err != nil {
+			vs.end(err)
+		}
+	}()
+
+	err := <-vs.ended
+	vs.close()
+	if err != nil {
+		srv.Warnf("vault session ended: %v", err)
+	}
+
+	return err
+}
+
+// vaultSess is a single session served by GrpcServer.VaultSession.
+type vaultSess struct {
+	srv     *GrpcServer
+	rpc     RepoGrpc_VaultSessionServer
+	echoes  vaultEchoes
+	pushed  chan pendingVaultTx
+	ended   chan error // receives the reason the session ended (nil if the peer ended it)
+	feeds   []TxFeed
+	closed  bool
+	closeMu sync.Mutex
+	sendMu  sync.Mutex
+}
+
+// end ends this session for the given reason (unless it has already ended).
+func (vs *vaultSess) end(reason error) {
+	select {
+	case vs.ended <- reason:
+	default:
+	}
+}
+
+// close closes each feed and stops any further msgs from being sent, since the rpc can't be used once VaultSession returns.
+func (vs *vaultSess) close() {
+	vs.closeMu.Lock()
+	vs.closed = true
+	for _, feed := range vs.feeds {
+		feed.Close()
+	}
+	vs.feeds = nil
+	vs.closeMu.Unlock()
+
+	// Wait for any msg being sent
+	vs.sendMu.Lock()
+	vs.sendMu.Unlock()
+}
+
+func (vs *vaultSess) isClosed() bool {
+	vs.closeMu.Lock()
+	defer vs.closeMu.Unlock()
+
+	return vs.closed
+}
+
+func (vs *vaultSess) send(vtx *VaultTx) error {
+	vs.sendMu.Lock()
+	defer vs.sendMu.Unlock()
+
+	if vs.isClosed() {
+		return ErrCode_ReqCanceled.ErrWithMsg("vault session ended")
+	}
+	return vs.rpc.Send(vtx)
+}
+
+func (vs *vaultSess) sendAck(pending pendingVaultTx) error {
+	return vs.send(&VaultTx{
+		DomainName: pending.domainName,
+		AckSeq:     pending.seq,
+	})
+}
+
+func (vs *vaultSess) recvLoop() {
+	defer close(vs.pushed)
+
+	for {
+		vtx, err := vs.rpc.Recv()
+		if err != nil {
+			if grpc.Code(err) != grpc_codes.Canceled {
+				vs.srv.Infof(2, "vault session ended: %v", err)
+			}
+			vs.end(nil)
+			return
+		}
+
+		if vtx.RawTx != nil {
+			vs.echoes.add(vtx.RawTx.TID)
+			txDone, err := vs.srv.host.ReceiveTx(vtx)
+			if err != nil {
+				vs.end(err)
+				return
+			}
+
+			select {
+			case vs.pushed <- pendingVaultTx{
+				domainName: vtx.DomainName,
+				seq:        vtx.MergeSeq,
+				txDone:     txDone,
+			}:
+			case <-vs.rpc.Context().Done():
+				return
+			}
+			continue
+		}
+
+		err = vs.openFeed(vtx.DomainName, vtx.FeedAfterSeq)
+		if err != nil {
+			vs.end(err)
+			return
+		}
+	}
+}
+
+// openFeed sends the given domain's merge log (following the given merge seq) to the peer until the session ends.
+func (vs *vaultSess) openFeed(domainName string, afterSeq uint64) error {
+	feed, err := vs.srv.host.OpenTxFeed(domainName, afterSeq)
+	if err != nil {
+		return err
+	}
+
+	vs.closeMu.Lock()
+	closed := vs.closed
+	if closed == false {
+		vs.feeds = append(vs.feeds, feed)
+	}
+	vs.closeMu.Unlock()
+	if closed {
+		feed.Close()
+		return nil
+	}
+
+	go func() {
+		for vtx := range feed.Outbox() {
+			if vs.echoes.take(vtx.RawTx.TID) {
+				continue
+			}
+			err := vs.send(&VaultTx{
+				DomainName: domainName,
+				RawTx:      vtx.RawTx,
+				MergeSeq:   vtx.MergeSeq,
+			})
+			if err != nil {
+				break
+			}
+		}
+		feed.Close()
+		vs.end(ErrCode_ReqCanceled.ErrWithMsgf("%v tx feed stopped: %v", domainName, feed.Ctx().CtxStopReason()))
+	}()
+
+	return nil
 }
 
 func (req *ChReq) newResponseFromCopy(src *Node) *Node {
@@ -408,12 +698,7 @@ func (req *ChReq) newResponse(op NodeOp, err error) *Node {
 	}
 
 	if err != nil {
-		var reqErr *ReqErr
-		if reqErr, _ = err.(*ReqErr); reqErr == nil {
-			err = ErrCode_UnnamedErr.Wrap(err)
-			reqErr = err.(*ReqErr)
-		}
-		node.Attachment = bufs.SmartMarshal(reqErr, node.Attachment)
+		node.Attachment = bufs.SmartMarshal(toReqErr(err), node.Attachment)
 	}
 
 	return node
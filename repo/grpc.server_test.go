@@ -0,0 +1,226 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	grpc_codes "google.golang.org/grpc/codes"
+	grpc_status "google.golang.org/grpc/status"
+)
+
+func TestTxOpCompletesOnceMerged(t *testing.T) {
+	A := startTestHost(t)
+	rpc := startTestRepoSession(t, A)
+
+	rpc.exchange(t, &ChReq{
+		ReqID: 1,
+		EnclaveAccess: &EnclaveAccess{
+			HiveName:       "alice",
+			HivePass:       []byte("alice pass"),
+			SigningKeyring: []byte("alice signing"),
+		},
+	}, NodeOp_ReqComplete)
+
+	// A tx op isn't complete until its tx is merged
+	done := rpc.exchange(t, &ChReq{
+		ReqID:      2,
+		ChStateURI: &ChStateURI{DomainName: testDomain},
+		TxOp: &TxOp{
+			ChannelGenesis: true,
+			Entries:        []*Node{{Keypath: "posts/hello", Str: "hello"}},
+		},
+	}, NodeOp_ReqComplete)
+	status, err := A.GetTxStatus(testDomain, done.Attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != TxState_Merged {
+		t.Fatalf("expected tx to be merged, got %v", status.State)
+	}
+
+	// Canceling a tx op ends it while its tx is still pending
+	d, err := A.(*host).holdDomain(testDomain, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer A.(*host).releaseDomain(d)
+	d.commitMu.Lock()
+	rpc.fromClient <- &ChReq{
+		ReqID:      3,
+		ChStateURI: &ChStateURI{DomainName: testDomain},
+		TxOp: &TxOp{
+			ChannelGenesis: true,
+			Entries:        []*Node{{Keypath: "posts/hello", Str: "hello"}},
+		},
+	}
+	discarded := rpc.exchange(t, &ChReq{ReqID: 3, ReqOp: ChReqOp_CancelReq}, NodeOp_ReqDiscarded)
+	d.commitMu.Unlock()
+
+	var reqErr ReqErr
+	if err = reqErr.Unmarshal(discarded.Attachment); err != nil {
+		t.Fatal(err)
+	}
+	if reqErr.Code != ErrCode_ReqCanceled {
+		t.Fatalf("expected req to be canceled, got %v", reqErr.Code)
+	}
+}
+
+func TestTxOpURI(t *testing.T) {
+	A := startTestHost(t)
+	rpc := startTestRepoSession(t, A)
+
+	rpc.exchange(t, &ChReq{
+		ReqID: 1,
+		EnclaveAccess: &EnclaveAccess{
+			HiveName:       "alice",
+			HivePass:       []byte("alice pass"),
+			SigningKeyring: []byte("alice signing"),
+		},
+	}, NodeOp_ReqComplete)
+
+	// A tx op can name its channel in the TxOp alone
+	done := rpc.exchange(t, &ChReq{
+		ReqID: 2,
+		TxOp: &TxOp{
+			ChStateURI:     &ChStateURI{DomainName: testDomain},
+			ChannelGenesis: true,
+			Entries:        []*Node{{Keypath: "posts/hello", Str: "hello"}},
+		},
+	}, NodeOp_ReqComplete)
+	if expect := testDomain + "/" + TID(done.Attachment).Base32(); done.Str != expect {
+		t.Fatalf("expected %q, got %q", expect, done.Str)
+	}
+
+	// A tx op that names no channel is rejected
+	discarded := rpc.exchange(t, &ChReq{
+		ReqID: 3,
+		TxOp: &TxOp{
+			Entries: []*Node{{Keypath: "posts/hello", Str: "hello"}},
+		},
+	}, NodeOp_ReqDiscarded)
+
+	var reqErr ReqErr
+	if err := reqErr.Unmarshal(discarded.Attachment); err != nil {
+		t.Fatal(err)
+	}
+	if reqErr.Code != ErrCode_InvalidURI {
+		t.Fatalf("expected an invalid URI, got %v", reqErr.Code)
+	}
+}
+
+func TestGetOpRequiresReadAccess(t *testing.T) {
+	A := startTestHost(t)
+	alice := startTestRepoSession(t, A)
+	anon := startTestRepoSession(t, A)
+
+	alice.exchange(t, &ChReq{
+		ReqID: 1,
+		EnclaveAccess: &EnclaveAccess{
+			HiveName:       "alice",
+			HivePass:       []byte("alice pass"),
+			SigningKeyring: []byte("alice signing"),
+		},
+	}, NodeOp_ReqComplete)
+	done := alice.exchange(t, &ChReq{
+		ReqID:      2,
+		ChStateURI: &ChStateURI{DomainName: testDomain},
+		TxOp: &TxOp{
+			ChannelGenesis: true,
+			Entries:        []*Node{{Keypath: "posts/hello", Str: "hello"}},
+		},
+	}, NodeOp_ReqComplete)
+	getOp := func(reqID int32) *ChReq {
+		return &ChReq{
+			ReqID:      reqID,
+			ChStateURI: &ChStateURI{DomainName: testDomain, ChID: TID(done.Attachment).Base32(), ChID_TID: done.Attachment},
+			GetOp:      &GetOp{Keypath: "posts", Scope: KeypathScope_Shallow},
+		}
+	}
+
+	// The channel's creator can read it, but a session whose member access hasn't been expanded can't
+	alice.exchange(t, getOp(3), NodeOp_ReqComplete)
+	discarded := anon.exchange(t, getOp(1), NodeOp_ReqDiscarded)
+
+	var reqErr ReqErr
+	if err := reqErr.Unmarshal(discarded.Attachment); err != nil {
+		t.Fatal(err)
+	}
+	if reqErr.Code != ErrCode_AccessDenied {
+		t.Fatalf("expected access denied, got %v", reqErr.Code)
+	}
+}
+
+// testRepoRPC is the server side of a repo session, exchanging msgs with a test acting as its client.
+type testRepoRPC struct {
+	ctx        context.Context
+	fromClient chan *ChReq
+	toClient   chan *Node
+}
+
+// startTestRepoSession serves a repo session on the given host that is ended when the test completes.
+func startTestRepoSession(t *testing.T, host Host) *testRepoRPC {
+	rpcCtx, cancel := context.WithCancel(context.Background())
+	rpc := &testRepoRPC{
+		ctx:        rpcCtx,
+		fromClient: make(chan *ChReq),
+		toClient:   make(chan *Node),
+	}
+
+	sessDone := make(chan struct{})
+	go func() {
+		NewGrpcServer(host, "", "").RepoServiceSession(rpc)
+		close(sessDone)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-sessDone
+	})
+
+	return rpc
+}
+
+func (rpc *testRepoRPC) Send(node *Node) error {
+	select {
+	case rpc.toClient <- node:
+		return nil
+	case <-rpc.ctx.Done():
+		return rpc.ctx.Err()
+	}
+}
+
+func (rpc *testRepoRPC) Recv() (*ChReq, error) {
+	select {
+	case chReq := <-rpc.fromClient:
+		return chReq, nil
+	case <-rpc.ctx.Done():
+		return nil, grpc_status.Error(grpc_codes.Canceled, "test complete")
+	}
+}
+
+func (rpc *testRepoRPC) Context() context.Context {
+	return rpc.ctx
+}
+
+// exchange sends the given req and returns the first msg sent back for it with the given op.
+func (rpc *testRepoRPC) exchange(t *testing.T, chReq *ChReq, op NodeOp) *Node {
+	rpc.fromClient <- chReq
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case node := <-rpc.toClient:
+			if node.ReqID != chReq.ReqID {
+				continue
+			}
+			if node.Op == op {
+				return node
+			}
+			if node.Op == NodeOp_ReqComplete || node.Op == NodeOp_ReqDiscarded {
+				t.Fatalf("expected %v for req %d, got %v", op, chReq.ReqID, node.Op)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for req %d", chReq.ReqID)
+		}
+	}
+}
@@ -3,16 +3,18 @@ package repo
 import (
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//"strings"
 	//"sort"
 	// crand "crypto/rand"
 	// "strings"
-	mrand "math/rand"
 
 	"github.com/plan-systems/plan-go/ctx"
 	"github.com/plan-systems/plan-go/device"
+	"github.com/plan-systems/plan-go/ski"
+	"github.com/plan-systems/plan-go/ski/Providers/hive"
 
 	"github.com/dgraph-io/badger/v3"
 	// "google.golang.org/grpc"
@@ -27,7 +29,7 @@ func NewHost(
 		// activeSessions: ctx.NewSessionGroup(),
 		// servicePort:    inServicePort,
 		params:              params,
-		domains:             make(map[string]Domain),
+		domains:             make(map[LID]*domain),
 		domainAutoStopDelay: 60 * time.Second,
 	}
 	pn.SetLogLabel("host")
@@ -39,6 +41,10 @@ func NewHost(
 
 	pn.stateDBPathname = path.Join(params.BasePath, "state.db")
 
+	if pn.hivesPath, err = device.ExpandAndCheckPath(path.Join(params.BasePath, "hives"), true); err != nil {
+		return nil, err
+	}
+
 	return pn, nil
 }
 
@@ -46,16 +52,29 @@ func NewHost(
 type HostParams struct {
 	DomainName string
 	BasePath   string
+
+	// Vaults replicate txns to and from this Host (started and stopped by the Host)
+	Vaults []Vault
 }
 
+// dbFormatKeypath is the reserved host-level keypath holding the format of the host's db keys (see dbFormat).
+const dbFormatKeypath = "/.format"
+
+// dbFormat is the current format of a host's db keys, bumped (along with a migration from the prior format) whenever the layout of stored keys changes.
+// Format 1 names keyspaces by LID and stores channel keypaths as ChKeys (see AppendChKey).
+const dbFormat = byte(1)
+
 type host struct {
 	ctx.Context
 
 	stateDBPathname     string
+	hivesPath           string
 	stateDB             *badger.DB
 	params              HostParams
 	txScrap             []byte
-	domains             map[string]Domain
+	lidSeq              *badger.Sequence // issues the LIDs of all domains and channels (see openLIDSeq)
+	domainLIDs          lidTable         // maps each domain name (and alias) to its domain's LID
+	domains             map[LID]*domain
 	domainsMu           sync.RWMutex
 	domainAutoStopDelay time.Duration
 	vaultMgr            *vaultMgr
@@ -77,7 +96,7 @@ func (host *host) Start() error {
 
 	err := host.CtxStart(
 		host.ctxStartup,
-		nil,
+		host.ctxStopIssued,
 		nil,
 		host.ctxStopping,
 	)
@@ -96,6 +115,17 @@ func (host *host) ctxStartup() error {
 		return err
 	}
 
+	err = host.checkDBFormat()
+	if err != nil {
+		return err
+	}
+
+	host.lidSeq, err = openLIDSeq(host.stateDB)
+	if err != nil {
+		return err
+	}
+	host.domainLIDs.open(host.stateDB, host.lidSeq, nil, domainLIDsKeypath)
+
 	host.vaultMgr = newVaultMgr(host)
 	err = host.vaultMgr.Start()
 	if err != nil {
@@ -108,15 +138,60 @@ func (host *host) ctxStartup() error {
 	return err
 }
 
+func (host *host) ctxStopIssued() {
+
+	// Stop vault traffic first so that no inbound txns are sent to a stopping domain.
+	if host.vaultMgr != nil {
+		host.vaultMgr.CtxStop("host stopping", nil)
+		host.vaultMgr.CtxWait()
+	}
+}
+
 func (host *host) ctxStopping() {
 
 	// Since domain are child contexts of this host, by the time we're here, they have all finished stopping.
 	// All that's left is to close the dbs
+	if host.lidSeq != nil {
+		if err := host.lidSeq.Release(); err != nil {
+			host.Warnf("failed to release LIDs: %v", err)
+		}
+	}
 	host.stateDB.Close()
 	host.stateDB = nil
 
 }
 
+// checkDBFormat returns an error if the host db was written in a format other than dbFormat, marking a new (empty) db with dbFormat.
+// A db holding keys but no format predates db formats (naming keyspaces by domain name and ChID), so it is refused rather than orphaned.
+func (host *host) checkDBFormat() error {
+	return host.stateDB.Update(func(dbTx *badger.Txn) error {
+		item, err := dbTx.Get([]byte(dbFormatKeypath))
+		if err == badger.ErrKeyNotFound {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			itr := dbTx.NewIterator(opts)
+			itr.Rewind()
+			isEmpty := itr.Valid() == false
+			itr.Close()
+
+			if isEmpty == false {
+				return ErrCode_CommitFailed.ErrWithMsg("unsupported db format (db predates format 1)")
+			}
+			return dbTx.Set([]byte(dbFormatKeypath), []byte{dbFormat})
+		}
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			if len(val) != 1 || val[0] != dbFormat {
+				return ErrCode_CommitFailed.ErrWithMsgf("unsupported db format %v (expected %v)", val, dbFormat)
+			}
+			return nil
+		})
+	})
+}
+
 // Start -- see interface Host
 func (host *host) DomainName() string {
 	return host.params.DomainName
@@ -124,76 +199,227 @@ func (host *host) DomainName() string {
 
 // NewSession -- see interface Host
 func (host *host) NewSession() MemberSession {
-	return &membSess{}
+	return &membSess{
+		host:   host,
+		packer: ski.NewPacker(true),
+	}
 }
 
 // OpenChSub -- see interface Host
-func (host *host) OpenChSub(chReq *ChReq) (ChSub, error) {
+func (host *host) OpenChSub(chReq *ChReq, reader MemberSession) (ChSub, error) {
 	uri := chReq.ChStateURI
 	if uri == nil || len(uri.DomainName) == 0 {
 		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
 	}
 
-	domain, err := host.getDomain(uri.DomainName, true)
+	domain, err := host.holdDomain(uri.DomainName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer host.releaseDomain(domain)
+	return domain.OpenChSub(chReq, reader)
+}
+
+// OpenDomainSub -- see interface Host
+func (host *host) OpenDomainSub(chReq *ChReq, reader MemberSession) (ChSub, error) {
+	if chReq.ChStateURI == nil || len(chReq.ChStateURI.DomainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
+	domain, err := host.holdDomain(chReq.ChStateURI.DomainName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer host.releaseDomain(domain)
+	return domain.OpenDomainSub(chReq, reader)
+}
+
+// OpenChDir -- see interface Host
+func (host *host) OpenChDir(chReq *ChReq) (ChSub, error) {
+	if chReq.ChStateURI == nil || len(chReq.ChStateURI.DomainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
+	domain, err := host.holdDomain(chReq.ChStateURI.DomainName, true)
 	if err != nil {
 		return nil, err
 	}
-	return domain.OpenChSub(chReq)
+	defer host.releaseDomain(domain)
+	return domain.OpenChDir(chReq)
 }
 
 // SubmitTx -- see interface Host
-func (host *host) SubmitTx(tx *Tx) error {
+func (host *host) SubmitTx(tx *Tx) (TxCompletion, error) {
 
 	if tx == nil || tx.TxOp == nil {
-		return ErrCode_NothingToCommit.ErrWithMsg("missing tx")
+		return nil, ErrCode_NothingToCommit.ErrWithMsg("missing tx")
 	}
 
 	uri := tx.TxOp.ChStateURI
 
 	if uri == nil || len(uri.DomainName) == 0 {
-		return ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
 	}
 
-	var err error
-	{
-		// Use the same time value each node we're commiting
-        timestampFS := device.TimeNowFS()
-		for _, entry := range tx.TxOp.Entries {
-			entry.Keypath, err = NormalizeKeypath(entry.Keypath)
-			if err != nil {
-				return err
-			}
+	if len(tx.TID) != TIDSz {
+		return nil, ErrCode_NothingToCommit.ErrWithMsg("missing TID (tx not signed)")
+	}
 
-			switch entry.Op {
-			case NodeOp_NodeUpdate:
-			case NodeOp_NodeRemove:
-			case NodeOp_NodeRemoveAll:
-			default:
-				err = ErrCode_CommitFailed.ErrWithMsg("unsupported NodeOp for entry")
-			}
+	err := host.issueDomain(uri.DomainName)
+	if err != nil {
+		return nil, err
+	}
 
-            if (entry.RevID == 0) {
-                entry.RevID = int64(timestampFS)
-            }
-		}
+	domain, err := host.holdDomain(uri.DomainName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer host.releaseDomain(domain)
+
+	return domain.SubmitTx(tx)
+}
+
+// ReceiveTx -- see interface Host
+func (host *host) ReceiveTx(vtx *VaultTx) (TxCompletion, error) {
+	return host.vaultMgr.ReceiveTx(vtx)
+}
+
+// OpenTxFeed -- see interface Host
+func (host *host) OpenTxFeed(domainName string, afterSeq uint64) (TxFeed, error) {
+	if len(domainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
+	domain, err := host.holdDomain(domainName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer host.releaseDomain(domain)
+	return domain.OpenTxFeed(afterSeq)
+}
+
+// GetTxStatus -- see interface Host
+func (host *host) GetTxStatus(domainName string, tid TID) (*TxStatus, error) {
+	if len(domainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
 	}
 
-	domain, err := host.getDomain(uri.DomainName, true)
+	domain, err := host.holdDomain(domainName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer host.releaseDomain(domain)
+	return domain.GetTxStatus(tid)
+}
+
+// OpenChTxFeed -- see interface Host
+func (host *host) OpenChTxFeed(uri *ChStateURI, fromTID TID, maintainSync bool, reader MemberSession) (TxFeed, error) {
+	if uri == nil || len(uri.DomainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+	if len(uri.ChID) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("missing channel ID")
+	}
+
+	domain, err := host.holdDomain(uri.DomainName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer host.releaseDomain(domain)
+	return domain.OpenChTxFeed(uri.ChID, fromTID, maintainSync, reader)
+}
+
+// AliasCh -- see interface Domain
+func (host *host) AliasCh(uri *ChStateURI, alias string) error {
+	if uri == nil || len(uri.DomainName) == 0 {
+		return ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
+	domain, err := host.holdDomain(uri.DomainName, true)
 	if err != nil {
 		return err
 	}
+	defer host.releaseDomain(domain)
+	return domain.AliasCh(uri, alias)
+}
 
-	err = domain.SubmitTx(tx)
+// AliasDomain -- see interface Host
+func (host *host) AliasDomain(domainName, alias string) error {
+	lid, err := host.resolveDomain(domainName, false)
 	if err != nil {
 		return err
 	}
+	return host.domainLIDs.alias(alias, lid, false)
+}
+
+// RenameDomain -- see interface Host
+func (host *host) RenameDomain(domainName, newName string) error {
+	lid, err := host.resolveDomain(domainName, false)
+	if err != nil {
+		return err
+	}
+
+	err = host.domainLIDs.alias(newName, lid, true)
+	if err != nil {
+		return err
+	}
+
+	// A mounted domain is stopped so that it is next mounted under its new name
+	host.domainsMu.Lock()
+	domain := host.domains[lid]
+	delete(host.domains, lid)
+	host.domainsMu.Unlock()
+
+	if domain != nil {
+		domain.CtxStop("domain renamed", nil)
+		domain.CtxWait()
+	}
 
 	return nil
 }
 
-func (host *host) getDomain(domainName string, autoMount bool) (Domain, error) {
+// resolveDomain returns the LID of the domain with the given name or alias, issuing a LID to a domain name seen for the first time (if autoIssue is set).
+func (host *host) resolveDomain(domainName string, autoIssue bool) (LID, error) {
+	if len(domainName) == 0 {
+		return 0, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
+	lid, err := host.domainLIDs.lookup(domainName)
+	if err == nil && lid == 0 {
+		if autoIssue == false {
+			return 0, ErrCode_DomainNotFound.ErrWithMsg(domainName)
+		}
+		lid, err = host.domainLIDs.issue(domainName)
+	}
+	return lid, err
+}
+
+// issueDomain issues a LID to the given domain name if it has never been seen before, so that it can then be mounted (see getDomain).
+// This is only done for a domain that a tx is submitted or replicated to.
+func (host *host) issueDomain(domainName string) error {
+	_, err := host.resolveDomain(domainName, true)
+	return err
+}
+
+// isDomainName returns true if the given name is the name (or an alias) of the given domain.
+func (host *host) isDomainName(domainName string, d *domain) bool {
+	if domainName == d.domainName {
+		return true
+	}
+	lid, err := host.domainLIDs.lookup(domainName)
+	return err == nil && lid == d.lid
+}
+
+// getDomain returns the mounted domain with the given name or alias (mounting it if autoMount is set).
+// A domain is only issued a LID when a tx is submitted or received for it (see issueDomain), so this never grows the db.
+func (host *host) getDomain(domainName string, autoMount bool) (*domain, error) {
+	lid, err := host.resolveDomain(domainName, false)
+	if err != nil {
+		return nil, err
+	}
+
 	host.domainsMu.RLock()
-	domain := host.domains[domainName]
+	domain := host.domains[lid]
 	host.domainsMu.RUnlock()
 
 	if domain != nil {
@@ -204,44 +430,75 @@ func (host *host) getDomain(domainName string, autoMount bool) (Domain, error) {
 		return nil, ErrCode_DomainNotFound.ErrWithMsg(domainName)
 	}
 
-	return host.mountDomain(domainName)
+	return host.mountDomain(lid)
 }
 
-func (host *host) mountDomain(domainName string) (Domain, error) {
+func (host *host) mountDomain(lid LID) (*domain, error) {
 	host.domainsMu.Lock()
 	defer host.domainsMu.Unlock()
 
-	domain := host.domains[domainName]
+	domain := host.domains[lid]
 	if domain != nil {
 		return domain, nil
 	}
 
-	domain = newDomain(domainName, host)
-	host.domains[domainName] = domain
+	// A domain is always known by its primary name, even when mounted via an alias
+	domainName, err := host.domainLIDs.primaryName(lid)
+	if err != nil {
+		return nil, err
+	}
 
-	err := domain.Start()
+	domain = newDomain(lid, domainName, host)
+	err = domain.Start()
 	if err != nil {
 		return nil, err
 	}
+	host.domains[lid] = domain
 	host.CtxAddChild(domain, nil)
 
 	return domain, nil
 }
 
-func (host *host) stopDomainIfIdle(d Domain) bool {
+// holdDomain returns the domain with the given name (mounting it as needed if autoMount is set), counting a hold against it so that it isn't stopped as idle.
+// The caller releases the hold via releaseDomain.
+func (host *host) holdDomain(domainName string, autoMount bool) (*domain, error) {
+	for {
+		d, err := host.getDomain(domainName, autoMount)
+		if err != nil {
+			return nil, err
+		}
+
+		// Count the hold while the domain can't be stopped as idle (see stopDomainIfIdle)
+		host.domainsMu.RLock()
+		isMounted := host.domains[d.lid] == d
+		if isMounted {
+			atomic.AddInt32(&d.holds, 1)
+		}
+		host.domainsMu.RUnlock()
+
+		if isMounted {
+			return d, nil
+		}
+	}
+}
+
+func (host *host) releaseDomain(d *domain) {
+	atomic.AddInt32(&d.holds, -1)
+}
+
+func (host *host) stopDomainIfIdle(d *domain) bool {
 	host.domainsMu.Lock()
 	defer host.domainsMu.Unlock()
 
 	didStop := false
 
-	domainName := d.DomainName()
-	if host.domains[domainName] == d {
+	if host.domains[d.lid] == d {
 		dctx := d.Ctx()
 
-		// With the domain's ch session mutex locked, we can reliably call CtxChildCount
-		if dctx.CtxChildCount() == 0 {
+		// With the host's domain mutex locked, we can reliably call CtxChildCount (and read holds)
+		if dctx.CtxChildCount() == 0 && atomic.LoadInt32(&d.holds) == 0 && d.hasPendingTxs() == false {
 			didStop = dctx.CtxStop("idle domain auto stop", nil)
-			delete(host.domains, domainName)
+			delete(host.domains, d.lid)
 		}
 	}
 
@@ -251,12 +508,105 @@ func (host *host) stopDomainIfIdle(d Domain) bool {
 type membSess struct {
 	//ctx.Context
 
+	host      *host
+	enclave   ski.EnclaveSession
+	enclaveMu sync.RWMutex
+	packer    ski.PayloadPacker
+	pubKey    []byte // pub key of the signing key in use (guarded by enclaveMu)
 }
 
+// ExpandAccess -- see interface MemberSession
 func (ms *membSess) ExpandAccess(access *EnclaveAccess) error {
+	if access == nil || len(access.HiveName) == 0 {
+		return ErrCode_AccessDenied.ErrWithMsg("missing key hive name")
+	}
+
+	if len(access.SigningKeyring) == 0 {
+		return ErrCode_AccessDenied.ErrWithMsg("missing signing keyring name")
+	}
+
+	hiveName := device.MakeFSFriendly(access.HiveName, nil)
+	enclave, err := hive.StartSession(ms.host.hivesPath, hiveName, access.HivePass)
+	if err != nil {
+		return ErrCode_AccessDenied.Wrap(err)
+	}
+
+	// A member's first access generates their signing key
+	_, err = enclave.FetchKeyInfo(&ski.KeyRef{
+		KeyringName: access.SigningKeyring,
+	})
+	if ski.IsError(err, ski.ErrCode_KeyringNotFound) {
+		_, err = ski.GenerateNewKey(
+			enclave,
+			access.SigningKeyring,
+			ski.KeyInfo{
+				KeyType:     ski.KeyType_SigningKey,
+				CryptoKitID: ski.CryptoKitID_ED25519,
+			},
+		)
+	}
+
+	ms.enclaveMu.Lock()
+	defer ms.enclaveMu.Unlock()
+
+	if err == nil {
+		err = ms.resetSigner(enclave, access.SigningKeyring)
+	}
+	if err != nil {
+		enclave.EndSession("expand access failed")
+		return ErrCode_AccessDenied.Wrap(err)
+	}
+
+	// Only one enclave is active at a time, so the newly expanded access replaces the previous
+	if ms.enclave != nil && ms.enclave != enclave {
+		ms.enclave.EndSession("member access replaced")
+	}
+	ms.enclave = enclave
+
+	return nil
+}
+
+// EndSession -- see interface MemberSession
+func (ms *membSess) EndSession(reason string) {
+	ms.enclaveMu.Lock()
+	if ms.enclave != nil {
+		ms.enclave.EndSession(reason)
+		ms.enclave = nil
+	}
+	ms.enclaveMu.Unlock()
+}
+
+// resetSigner readies this session to sign newly authored txns using the newest signing key on the given keyring.
+//
+// Pre: ms.enclaveMu is locked
+func (ms *membSess) resetSigner(enclave ski.EnclaveSession, signingKeyring []byte) error {
+	var keyInfo ski.KeyInfo
+	err := ms.packer.ResetSession(
+		enclave,
+		ski.KeyRef{
+			KeyringName: signingKeyring,
+		},
+		TxHashKitID,
+		&keyInfo,
+	)
+	if err != nil {
+		return err
+	}
+
+	ms.pubKey = keyInfo.PubKey
 	return nil
 }
 
+// PubKey -- see interface MemberSession
+func (ms *membSess) PubKey() []byte {
+	ms.enclaveMu.RLock()
+	defer ms.enclaveMu.RUnlock()
+
+	if ms.enclave == nil {
+		return nil
+	}
+	return ms.pubKey
+}
 
 func (ms *membSess) EncodeToTxAndSign(txOp *TxOp) (*Tx, error) {
 
@@ -264,33 +614,82 @@ func (ms *membSess) EncodeToTxAndSign(txOp *TxOp) (*Tx, error) {
 		return nil, ErrCode_NothingToCommit.ErrWithMsg("missing txOp")
 	}
 
-	if len(txOp.Entries) == 0 {
+	if txOp.EntryCount() == 0 {
 		return nil, ErrCode_NothingToCommit.ErrWithMsg("no entries to commit")
 	}
 
+	if txOp.ChStateURI == nil || len(txOp.ChStateURI.DomainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
 	if txOp.ChannelGenesis == false && len(txOp.ChStateURI.ChID_TID) < 16 {
 		return nil, ErrCode_NothingToCommit.ErrWithMsg("invalid ChID (missing TID)")
 	}
 
-	//
-	// TODO
-	//
-	// placeholder until tx encoding and signing is
-	var TID TIDBuf
-	mrand.Read(TID[:])
+	// Use the same time value for the TID and each node we're committing
+	timestampFS := device.TimeNowFS()
+
+	// Entries must be in final form before they are signed
+	err := txOp.NormalizeEntries(timestampFS)
+	if err != nil {
+		return nil, err
+	}
+
+	rawTx, err := ms.signTxOp(txOp, timestampFS)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := &Tx{
-		TID:  TID[:],
-		TxOp: txOp,
+		TID:   rawTx.TID,
+		TxOp:  txOp,
+		RawTx: rawTx,
 	}
 
+	// A new channel's ID is derived from its genesis TID, so it can only be assigned after signing.
 	if txOp.ChannelGenesis {
-		// if len(uri.ChID) > 0 {
-		// 	return ErrCode_InvalidURI.ErrWithMsg("URI must be a domain name and not be a path")
-		// }
 		txOp.ChStateURI.ChID_TID = tx.TID
-		txOp.ChStateURI.ChID = TID.Base32()
+		txOp.ChStateURI.ChID = TID(tx.TID).Base32()
 	}
 
 	return tx, nil
 }
+
+// signTxOp marshals the given TxOp and signs it along with the given timestamp, returning the resulting RawTx.
+//
+// The TID of the returned RawTx is formed from the timestamp and the signed hash, so it can be verified by any recipient.
+func (ms *membSess) signTxOp(txOp *TxOp, timestampFS device.TimeFS) (*RawTx, error) {
+	var header [TxHeaderSz]byte
+	TID(header[:]).SetTimeFS(timestampFS)
+
+	body, err := txOp.Marshal()
+	if err != nil {
+		return nil, ErrCode_CommitFailed.Wrap(err)
+	}
+
+	var packed ski.PackingInfo
+	ms.enclaveMu.RLock()
+	if ms.enclave == nil {
+		err = ErrCode_AccessDenied.ErrWithMsg("member access not expanded")
+	} else {
+		err = ms.packer.PackAndSign(
+			TxHeaderCodec,
+			header[:],
+			body,
+			0,
+			&packed,
+		)
+	}
+	ms.enclaveMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	rawTx := &RawTx{
+		TID:   make([]byte, TIDSz),
+		Bytes: packed.SignedBuf,
+	}
+	TID(rawTx.TID).SetTimeAndHash(timestampFS, packed.Hash)
+
+	return rawTx, nil
+}
@@ -0,0 +1,62 @@
+package repo
+
+import (
+	"path"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+func TestLegacyDBRefused(t *testing.T) {
+	basePath := t.TempDir()
+
+	// A db written before db formats names its keyspaces by domain name
+	opts := badger.DefaultOptions(path.Join(basePath, "state.db"))
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(dbTx *badger.Txn) error {
+		return dbTx.Set([]byte(testDomain+"/.chdir/legacy"), []byte("legacy"))
+	})
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := NewHost(HostParams{
+		BasePath: basePath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = host.Start(); err == nil {
+		host.Ctx().CtxStop("test complete", nil)
+		host.Ctx().CtxWait()
+		t.Fatal("expected a legacy db to be refused")
+	}
+}
+
+func TestDBFormatKeptOnRestart(t *testing.T) {
+	basePath := t.TempDir()
+
+	for i := 0; i < 2; i++ {
+		host, err := NewHost(HostParams{
+			BasePath: basePath,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = host.Start(); err != nil {
+			t.Fatal(err)
+		}
+		alice := newTestMember(t, host, "alice")
+		newTestChannel(t, host, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+		host.Ctx().CtxStop("test complete", nil)
+		host.Ctx().CtxWait()
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/plan-systems/plan-go/bufs"
 	"github.com/plan-systems/plan-go/device"
+	"github.com/plan-systems/plan-go/ski"
 )
 
 // TIDSz is the byte size of a TID, a hash with a leading embedded big endian binary time index.
@@ -14,6 +15,142 @@ const TIDSz = int(Const_TIDSz)
 // TIDEncodedLen is the ASCII-compatible string length of a (binary) TID encoded into its base32 form.
 const TIDEncodedLen = int(Const_TIDEncodedLen)
 
+// TxHeaderCodec identifies the signed header format of a RawTx (see TxHeaderSz).
+const TxHeaderCodec = uint32(0x54580001)
+
+// TxHeaderSz is the byte size of the signed header of a RawTx: the big endian TimeFS of when the tx was authored.
+// The remainder of the signed payload is the marshalled TxOp.
+const TxHeaderSz = 8
+
+// TxHashKitID is the hash kit used to generate the signed digest of a RawTx (and in turn, its TID).
+const TxHashKitID = ski.HashKitID_Blake2b_256
+
+// DecodeRawTx unpacks the given RawTx, verifies its signature and TID, and returns the resulting Tx.
+//
+// The given unpacker is used to verify the signature and is reused across calls (so the caller can avoid reallocations).
+func DecodeRawTx(rawTx *RawTx, unpacker *ski.PayloadUnpacker) (*Tx, error) {
+	var payload ski.SignedPayload
+
+	err := unpacker.UnpackAndVerify(rawTx.Bytes, &payload)
+	if err != nil {
+		return nil, ErrCode_TxSigInvalid.Wrap(err)
+	}
+
+	if payload.HeaderCodec != TxHeaderCodec || len(payload.Header) != TxHeaderSz {
+		return nil, ErrCode_TxMalformed.ErrWithMsgf("unrecognized tx header (codec %v)", payload.HeaderCodec)
+	}
+
+	// The TID must be formed from the signed timestamp and the signed hash (or the TID was forged or altered)
+	var expected TIDBuf
+	timestampFS := TID(payload.Header).ExtractTimeFS()
+	expected.TID().SetTimeAndHash(timestampFS, payload.Hash)
+	if bytes.Equal(expected[:], rawTx.TID) == false {
+		return nil, ErrCode_TIDMismatch.ErrWithMsgf("TID %v does not match signed hash", TID(rawTx.TID).SuffixStr())
+	}
+
+	tx := &Tx{
+		TID:    expected[:],
+		TxOp:   &TxOp{},
+		RawTx:  rawTx,
+		Signer: payload.Signer.PubKey,
+	}
+
+	err = tx.TxOp.Unmarshal(payload.Body)
+	if err != nil {
+		return nil, ErrCode_TxMalformed.Wrap(err)
+	}
+
+	if tx.TxOp.ChStateURI == nil || len(tx.TxOp.ChStateURI.DomainName) == 0 {
+		return nil, ErrCode_TxMalformed.ErrWithMsg("missing tx domain name")
+	}
+
+	// See membSess.EncodeToTxAndSign()
+	if tx.TxOp.ChannelGenesis {
+		tx.TxOp.ChStateURI.ChID_TID = tx.TID
+		tx.TxOp.ChStateURI.ChID = TID(tx.TID).Base32()
+	} else if len(tx.TxOp.ChStateURI.ChID_TID) > 0 {
+		tx.TxOp.ChStateURI.ChID = TID(tx.TxOp.ChStateURI.ChID_TID).Base32()
+	} else {
+		return nil, ErrCode_TxMalformed.ErrWithMsg("missing tx channel ID")
+	}
+
+	// A glob is only meaningful in a GetOp pattern (see normalizeEntries)
+	if err = checkNoGlobs(tx.TxOp.Entries); err != nil {
+		return nil, err
+	}
+
+	// Each additional channel can only be listed once (and must already exist where the tx is authored -- see chSess.mergeTx)
+	for i, chEntries := range tx.TxOp.ChEntries {
+		if len(chEntries.ChID_TID) == 0 {
+			return nil, ErrCode_TxMalformed.ErrWithMsg("missing tx channel ID")
+		}
+		chEntries.ChID = TID(chEntries.ChID_TID).Base32()
+		if chEntries.ChID == tx.TxOp.ChStateURI.ChID {
+			return nil, ErrCode_TxMalformed.ErrWithMsg("tx channel listed more than once")
+		}
+		for _, prev := range tx.TxOp.ChEntries[:i] {
+			if prev.ChID == chEntries.ChID {
+				return nil, ErrCode_TxMalformed.ErrWithMsg("tx channel listed more than once")
+			}
+		}
+		if err = checkNoGlobs(chEntries.Entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
+
+// checkNoGlobs returns an error if the keypath of any of the given received entries has a glob component.
+func checkNoGlobs(entries []*Node) error {
+	for _, entry := range entries {
+		if hasGlobComp(entry.Keypath) {
+			return ErrCode_TxMalformed.ErrWithMsgf("entry keypath %q has a glob component", entry.Keypath)
+		}
+	}
+	return nil
+}
+
+// WritesToCh returns true if this TxOp writes to the given channel (as its primary channel or via ChEntries).
+func (txOp *TxOp) WritesToCh(chID string) bool {
+	if txOp.ChStateURI != nil && txOp.ChStateURI.ChID == chID {
+		return true
+	}
+	for _, chEntries := range txOp.ChEntries {
+		if chEntries.ChID == chID {
+			return true
+		}
+	}
+	return false
+}
+
+// EntryCount returns the number of entries this TxOp writes across all the channels it writes to.
+func (txOp *TxOp) EntryCount() int {
+	N := len(txOp.Entries)
+	for _, chEntries := range txOp.ChEntries {
+		N += len(chEntries.Entries)
+	}
+	return N
+}
+
+// ACLKeypath is the reserved channel keypath containing the channel's access control list.
+//
+// Each ACL entry is keyed by a member's base32 pub key ("ACLKeypath/<PubKey>"), with Node.Int holding the member's ChRights.
+const ACLKeypath = ".acl"
+
+// ChNameKeypath is the reserved channel keypath holding the channel's name (in Node.Str), as listed in its domain's channel directory (see ChInfo).
+// Like the ACL, it can only be written by a member with AdminAccess.
+const ChNameKeypath = ".chname"
+
+// IsACLKeypath returns true if the given (normalized) keypath is the channel ACL or is an entry within it.
+func IsACLKeypath(keypath string) bool {
+	if strings.HasPrefix(keypath, ACLKeypath) {
+		N := len(ACLKeypath)
+		return len(keypath) == N || keypath[N] == '/'
+	}
+	return false
+}
+
 // nilTID is a zeroed TID that denotes a void/nil/zero value of a TID
 var nilTID = TIDBuf{}
 
@@ -96,9 +233,104 @@ func (uri *ChStateURI) FormChURI() (string, error) {
 }
 
 
-// ChKey is a keypath used in a repo db
+// NormalizeEntries normalizes the keypath of each entry in this TxOp (including its ChEntries) and assigns the given revision to each entry that does not specify one.
+func (txOp *TxOp) NormalizeEntries(revID device.TimeFS) error {
+	err := normalizeEntries(txOp.Entries, revID)
+
+	for i := 0; i < len(txOp.ChEntries) && err == nil; i++ {
+		err = normalizeEntries(txOp.ChEntries[i].Entries, revID)
+	}
+
+	return err
+}
+
+func normalizeEntries(entries []*Node, revID device.TimeFS) error {
+	var err error
+
+	for _, entry := range entries {
+		entry.Keypath, err = NormalizeKeypath(entry.Keypath)
+		if err != nil {
+			return err
+		}
+		if hasGlobComp(entry.Keypath) {
+			return ErrCode_InvalidKeypath.ErrWithMsgf("keypath %q has a glob component", entry.Keypath)
+		}
+
+		switch entry.Op {
+		case NodeOp_NodeUpdate:
+		case NodeOp_NodeRemove:
+		case NodeOp_NodeRemoveAll:
+		default:
+			return ErrCode_CommitFailed.ErrWithMsg("unsupported NodeOp for entry")
+		}
+
+		switch entry.Precondition {
+		case Precondition_None:
+		case Precondition_MustExist:
+		case Precondition_MustNotExist:
+		case Precondition_RevIDMatches:
+		default:
+			return ErrCode_CommitFailed.ErrWithMsg("unsupported Precondition for entry")
+		}
+
+		if entry.RevID == 0 {
+			entry.RevID = int64(revID)
+		}
+	}
+
+	return nil
+}
+
+// ChKey is a keypath as encoded within a repo db key (see AppendChKey).
+//
+// Each keypath component is encoded as its byte length followed by its bytes rather than separated by '/', so the ChKey of a keypath
+// leads the ChKey of each keypath under it (and no other), and a ChKey's components are read without scanning for a separator.
 type ChKey []byte
 
+// KeypathCompMaxSz is the max byte length of a keypath component.
+// An encoded component therefore never leads with 0xFF, so a key followed by 0xFF sorts after every key under it.
+const KeypathCompMaxSz = 0xFE
+
+// AppendChKey appends the ChKey of the given normalized keypath to the given key.
+func AppendChKey(key []byte, keypath string) ChKey {
+	for len(keypath) > 0 {
+		comp := keypath
+		if idx := strings.IndexByte(keypath, '/'); idx >= 0 {
+			comp, keypath = keypath[:idx], keypath[idx+1:]
+		} else {
+			keypath = ""
+		}
+		key = append(append(key, byte(len(comp))), comp...)
+	}
+	return key
+}
+
+// AppendComps appends each component of this ChKey to the given slice.
+func (key ChKey) AppendComps(comps []string) ([]string, error) {
+	for len(key) > 0 {
+		compLen := int(key[0])
+		if compLen == 0 || compLen >= len(key) {
+			return comps, ErrCode_InvalidKeypath.ErrWithMsg("malformed ChKey")
+		}
+		comps = append(comps, string(key[1:1+compLen]))
+		key = key[1+compLen:]
+	}
+	return comps, nil
+}
+
+// Keypath returns the keypath this ChKey encodes.
+func (key ChKey) Keypath() (string, error) {
+	var buf [8]string
+	comps, err := key.AppendComps(buf[:0])
+	return strings.Join(comps, "/"), err
+}
+
+// String returns the keypath this ChKey encodes (for logging).
+func (key ChKey) String() string {
+	keypath, _ := key.Keypath()
+	return keypath
+}
+
 
 // TID is a convenience function that returns the TID contained within this TIDBuf.
 func (tid *TIDBuf) TID() TID {
@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeKeypath(t *testing.T) {
+	long := strings.Repeat("x", KeypathCompMaxSz+1)
+
+	tests := []struct {
+		keypath string
+		expect  string
+		isValid bool
+	}{
+		{"posts/hello", "posts/hello", true},
+		{"/posts/hello/", "posts/hello", true},
+		{"a/b", "a/b", true},
+		{"posts/*/x", "posts/*/x", true},
+		{"", "", false},
+		{"/", "", false},
+		{"posts//hello", "", false},
+		{"posts/" + long, "", false},
+	}
+	for _, test := range tests {
+		keypath, err := NormalizeKeypath(test.keypath)
+		if (err == nil) != test.isValid || keypath != test.expect {
+			t.Errorf("%q: expected %q (valid: %v), got %q (%v)", test.keypath, test.expect, test.isValid, keypath, err)
+		}
+	}
+}
+
+func TestNormalizeEntries(t *testing.T) {
+
+	// A written keypath can't have a glob component, since a GetOp pattern couldn't tell it from a glob
+	for _, keypath := range []string{"posts/*", "**/x", "posts/*/x"} {
+		err := normalizeEntries([]*Node{{Keypath: keypath}}, 1)
+		if reqErr := toReqErr(err); reqErr == nil || reqErr.Code != ErrCode_InvalidKeypath {
+			t.Errorf("%q: expected an invalid keypath, got %v", keypath, reqErr)
+		}
+	}
+	for _, keypath := range []string{"posts/*x", "a/b", "x**"} {
+		if err := normalizeEntries([]*Node{{Keypath: keypath}}, 1); err != nil {
+			t.Errorf("%q: expected a valid keypath, got %v", keypath, err)
+		}
+	}
+}
+
+func TestChKey(t *testing.T) {
+	for _, keypath := range []string{"a", "a/b", "posts/hello/world", ".chname"} {
+		key := AppendChKey(nil, keypath)
+		decoded, err := key.Keypath()
+		if err != nil || decoded != keypath {
+			t.Errorf("%q: expected round trip, got %q (%v)", keypath, decoded, err)
+		}
+	}
+
+	// A keypath's ChKey leads the ChKeys under it but not those of its siblings that share its prefix
+	parent := AppendChKey(nil, "a")
+	if child := AppendChKey(nil, "a/b"); bytes.HasPrefix(child, parent) == false || PathIsShallow(child, parent) == false {
+		t.Error("expected a/b to be a shallow child of a")
+	}
+	if sibling := AppendChKey(nil, "ab/c"); bytes.HasPrefix(sibling, parent) {
+		t.Error("expected ab/c not to be under a")
+	}
+	if PathIsShallow(AppendChKey(nil, "a/b/c"), parent) {
+		t.Error("expected a/b/c not to be a shallow child of a")
+	}
+}
@@ -10,6 +10,26 @@ type TID []byte
 // TIDBuf is the blob version of a TID
 type TIDBuf [Const_TIDSz]byte
 
+// ChRights is a bitmask of the rights a member has on a channel, as stored in the channel's ACL (see ACLKeypath).
+type ChRights uint32
+
+// A member reads a channel via a MemberSession whose access has been expanded (see MemberSession.PubKey).
+// Vault peers replicate a domain's txns regardless of rights (see Host.OpenTxFeed).
+const (
+
+	// ReadAccess allows a member to read a channel's entries (including as of an earlier time) and its tx log.
+	ReadAccess ChRights = 1 << iota
+
+	// WriteAccess allows a member to write a channel's entries (outside of the channel's ACL).
+	WriteAccess
+
+	// AdminAccess allows a member to write entries in the channel's ACL.
+	AdminAccess
+
+	// AllAccess is granted to the member who creates a channel.
+	AllAccess = ReadAccess | WriteAccess | AdminAccess
+)
+
 // ChSub returns a stream of requested entries, closing Outbox() when complete (or when Close() is called)
 type ChSub interface {
 	ctx.Ctx
@@ -29,6 +49,24 @@ type MemberSession interface {
 
 	// Accesses the currently set of activated enclaves and attempts to sign a newly authored transaction
 	EncodeToTxAndSign(txOp *TxOp) (*Tx, error)
+
+	// PubKey returns the public key this session signs txns with (or nil if access has not been expanded).
+	// This identifies the member when reading a channel (see ChRights).
+	PubKey() []byte
+
+	// EndSession ends all enclave sessions opened via ExpandAccess().
+	// Following a call to EndSession(), no more calls into this interface should be made.
+	EndSession(reason string)
+}
+
+// TxCompletion reports the outcome of a tx passed to SubmitTx().
+type TxCompletion interface {
+
+	// Done returns a channel that is closed once the tx has been merged or rejected.
+	Done() <-chan struct{}
+
+	// Err blocks until Done() is closed and then returns nil if the tx was merged or the reason it was rejected.
+	Err() error
 }
 
 // Domain is a channel controlled for a family of channels all sharing the same domain.
@@ -38,17 +76,78 @@ type Domain interface {
 	// Places this Domain on service
 	Start() error
 
-	// OpenChSub services a channel Get request.
-	OpenChSub(chReq *ChReq) (ChSub, error)
+	// OpenChSub services a channel Get request on behalf of the given reader, who must have ReadAccess to the channel.
+	// If the reader's ReadAccess is revoked while the sub maintains sync, the sub is stopped.
+	OpenChSub(chReq *ChReq, reader MemberSession) (ChSub, error)
+
+	// OpenDomainSub streams each change merged into any channel of the domain that is within the given GetOp's scope and filters.
+	// Each change is tagged with its channel's ChID (see Node.ChID), and only changes merged after the sub is opened are sent.
+	// Only changes to channels the given reader has ReadAccess to are sent.
+	OpenDomainSub(chReq *ChReq, reader MemberSession) (ChSub, error)
+
+	// OpenChDir lists the channels of the domain (optionally narrowed by ChReq.ChDirOp), sending a ChInfo node for each.
+	// If ChDirOp.MaintainSync is set, the listing is followed by ChSyncResume and then a ChInfo node for each channel added or renamed.
+	OpenChDir(chReq *ChReq) (ChSub, error)
+
+	// AliasCh maps the given alias to the channel named by the given ChStateURI, allowing the alias to be used in place of the channel's ChID.
+	// An alias is local to this host, can't have the form of a ChID, and can't be reused for another channel.
+	AliasCh(uri *ChStateURI, alias string) error
 
 	// SubmitTx takes ownership of the given tx and inserts it into the Host pipeline to be validated and merged.
 	// If the given Tx is retained, it should be treated as read-only at this point onward.
-	SubmitTx(tx *Tx) error
+	// The returned TxCompletion reports whether the tx was merged or rejected.
+	SubmitTx(tx *Tx) (TxCompletion, error)
 
 	// DomainName uniquely identifies this Domain
 	DomainName() string
 }
 
+// Vault is a pluggable replication transport that streams signed txns into and out of a Host.
+type Vault interface {
+	ctx.Ctx
+
+	// Start places this Vault on service, passing each inbound tx to the given VaultHost.
+	Start(host VaultHost) error
+
+	// PublishTx sends the given locally authored tx outward.
+	// A Vault that sends txns from its host's merge log instead (see VaultHost.OpenTxFeed) can ignore this.
+	// The given VaultTx should be treated as read-only.
+	PublishTx(vtx *VaultTx)
+}
+
+// VaultHost receives txns arriving from a Vault.
+type VaultHost interface {
+
+	// ReceiveTx takes ownership of the given tx and inserts it into the Host pipeline to be validated and merged.
+	// The returned TxCompletion completes once the tx is merged or rejected.
+	ReceiveTx(vtx *VaultTx) (TxCompletion, error)
+
+	// OpenTxFeed streams each signed tx merged into the given domain after the given merge seq (see Host.OpenTxFeed).
+	OpenTxFeed(domainName string, afterSeq uint64) (TxFeed, error)
+
+	// ReadVaultCursor returns the cursor last saved via SaveVaultCursor() for the given vault and domain (or a zero cursor if none was saved).
+	ReadVaultCursor(vaultID, domainName string) (VaultCursor, error)
+
+	// SaveVaultCursor persists where a vault left off replicating a domain, so that it can resume after a restart.
+	SaveVaultCursor(vaultID, domainName string, cursor VaultCursor) error
+}
+
+// VaultCursor is where a Vault left off replicating a domain with its peer.
+// Each field is a merge seq (see VaultTx.MergeSeq), so replication resumes in merge order.
+type VaultCursor struct {
+	RecvSeq uint64 // peer merge seq of the last tx received from the peer and merged here
+	SentSeq uint64 // local merge seq of the last tx sent to the peer and acknowledged by it
+}
+
+// TxFeed streams the signed txns merged into a domain (or channel), closing Outbox() when complete (or when Close() is called).
+// Each tx sent by a domain feed carries its merge seq.
+type TxFeed interface {
+	ctx.Ctx
+
+	Outbox() <-chan *VaultTx
+	Close()
+}
+
 // Host is the highest level repo controller.  It accepts incoming txns, report status of their processing, and serves channel content.
 type Host interface {
 	ctx.Ctx
@@ -57,4 +156,28 @@ type Host interface {
 
 	// TODO: see comments in RepoServiceSession()
 	NewSession() MemberSession
+
+	// ReceiveTx takes ownership of the given tx (pushed from a peer) and inserts it into the Host pipeline to be validated and merged.
+	// The returned TxCompletion completes once the tx is merged or rejected.
+	ReceiveTx(vtx *VaultTx) (TxCompletion, error)
+
+	// OpenTxFeed streams each signed tx merged into the given domain after the given merge seq and remains open for newly merged txns.
+	// Txns are sent in the order they were merged into the domain (see VaultTx.MergeSeq), so a feed resumed from the last seq received misses nothing.
+	// This feed replicates the domain to vault peers, so it isn't subject to channel rights.
+	OpenTxFeed(domainName string, afterSeq uint64) (TxFeed, error)
+
+	// GetTxStatus returns whether the tx with the given TID is pending, merged, rejected, or unknown to the given domain.
+	GetTxStatus(domainName string, tid TID) (*TxStatus, error)
+
+	// OpenChTxFeed streams each signed tx merged into the given channel with a TID after fromTID on behalf of the given reader,
+	// who must have ReadAccess to the channel.
+	// If maintainSync is set, the feed remains open for newly merged txns (until the reader's ReadAccess is revoked).
+	OpenChTxFeed(uri *ChStateURI, fromTID TID, maintainSync bool, reader MemberSession) (TxFeed, error)
+
+	// AliasDomain maps the given alias to the given domain, allowing the alias to be used in place of the domain's name.
+	AliasDomain(domainName, alias string) error
+
+	// RenameDomain makes the given new name the name of the given domain, keeping its previous name as an alias.
+	// If the domain is mounted, it is stopped (ending its subs and canceling its pending txns) so that it is next mounted under its new name.
+	RenameDomain(domainName, newName string) error
 }
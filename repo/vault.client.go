@@ -1,49 +1,170 @@
 package repo
 
 import (
+	"encoding/binary"
 
-    "github.com/plan-systems/plan-go/ctx"
+	"github.com/plan-systems/plan-go/ctx"
 
+	"github.com/dgraph-io/badger/v3"
 )
 
+// vaultCursorKeypath is the reserved host-level keypath where each vault's per-domain cursor is stored.
+const vaultCursorKeypath = "/.vault/"
 
+// vaultCursorSz is the byte size of a stored VaultCursor: its big endian RecvSeq followed by its big endian SentSeq.
+const vaultCursorSz = 16
+
+// vaultMgr starts and stops each Vault given to a Host, routing inbound txns to domains and publishing locally authored txns outward.
 type vaultMgr struct {
-    ctx.Context
+	ctx.Context
 
-    host *host
+	host   *host
+	vaults []Vault
 }
 
-
 func newVaultMgr(host *host) *vaultMgr {
-    return &vaultMgr{
-        host: host,
-    }
+	return &vaultMgr{
+		host:   host,
+		vaults: host.params.Vaults,
+	}
 }
 
 // Start -- see interface Domain
 func (vm *vaultMgr) Start() error {
-    err := vm.CtxStart(
-        vm.ctxStartup,
-        nil,
-        nil,
-        vm.ctxStopping,
-    )
-    return err
+	err := vm.CtxStart(
+		vm.ctxStartup,
+		nil,
+		nil,
+		vm.ctxStopping,
+	)
+	return err
 }
 
-
 func (vm *vaultMgr) ctxStartup() error {
 
-    vm.SetLogLabel("vault mgr")
+	vm.SetLogLabel("vault mgr")
 
-    // TODO: startup vault access here
-    return nil
+	for _, vault := range vm.vaults {
+		err := vault.Start(vm)
+		if err != nil {
+			return err
+		}
 
-}
+		// Each vault is a child ctx so that it stops before the vaultMgr finishes stopping
+		vm.CtxAddChild(vault, nil)
+	}
 
+	return nil
+}
 
 func (vm *vaultMgr) ctxStopping() {
 
-    // TODO: initiate vault access shutdown
+	// Since each vault is a child ctx, by the time we're here, they have all finished stopping.
+	vm.Info(2, "all vaults stopped")
 }
 
+// ReceiveTx -- see interface VaultHost
+func (vm *vaultMgr) ReceiveTx(vtx *VaultTx) (TxCompletion, error) {
+	if vtx == nil || vtx.RawTx == nil {
+		return nil, ErrCode_NothingToCommit.ErrWithMsg("missing RawTx")
+	}
+
+	if len(vtx.DomainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+
+	if vm.CtxRunning() == false {
+		return nil, ErrCode_ReqCanceled.ErrWithMsg("vault mgr stopping")
+	}
+
+	err := vm.host.issueDomain(vtx.DomainName)
+	if err != nil {
+		return nil, err
+	}
+
+	domain, err := vm.host.holdDomain(vtx.DomainName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer vm.host.releaseDomain(domain)
+
+	tc := &txCompletion{
+		done: make(chan struct{}),
+	}
+	domain.submitRawTx(vtx.RawTx, tc, false)
+
+	return tc, nil
+}
+
+// OpenTxFeed -- see interface VaultHost
+//
+// A vault replicates the domains it is configured with, so a domain not yet seen here is issued a LID (see host.issueDomain).
+func (vm *vaultMgr) OpenTxFeed(domainName string, afterSeq uint64) (TxFeed, error) {
+	if len(domainName) == 0 {
+		return nil, ErrCode_InvalidURI.ErrWithMsg("no domain name given")
+	}
+	if err := vm.host.issueDomain(domainName); err != nil {
+		return nil, err
+	}
+	return vm.host.OpenTxFeed(domainName, afterSeq)
+}
+
+// ReadVaultCursor -- see interface VaultHost
+//
+// A cursor stored in an earlier format is read as a zero cursor, so that replication restarts from the beginning (since merging is idempotent).
+func (vm *vaultMgr) ReadVaultCursor(vaultID, domainName string) (VaultCursor, error) {
+	var cursor VaultCursor
+
+	err := vm.host.stateDB.View(func(dbTx *badger.Txn) error {
+		item, err := dbTx.Get(vaultCursorKey(vaultID, domainName))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) == vaultCursorSz {
+				cursor.RecvSeq = binary.BigEndian.Uint64(val[0:])
+				cursor.SentSeq = binary.BigEndian.Uint64(val[8:])
+			}
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		err = nil
+	}
+
+	return cursor, err
+}
+
+// SaveVaultCursor -- see interface VaultHost
+func (vm *vaultMgr) SaveVaultCursor(vaultID, domainName string, cursor VaultCursor) error {
+	var val [vaultCursorSz]byte
+	binary.BigEndian.PutUint64(val[0:], cursor.RecvSeq)
+	binary.BigEndian.PutUint64(val[8:], cursor.SentSeq)
+
+	return vm.host.stateDB.Update(func(dbTx *badger.Txn) error {
+		return dbTx.Set(vaultCursorKey(vaultID, domainName), val[:])
+	})
+}
+
+func vaultCursorKey(vaultID, domainName string) []byte {
+	key := make([]byte, 0, len(vaultCursorKeypath)+len(vaultID)+1+len(domainName))
+	key = append(append(key, vaultCursorKeypath...), vaultID...)
+	key = append(key, '/')
+	return append(key, domainName...)
+}
+
+// publishTx sends the given locally authored RawTx to each vault.
+func (vm *vaultMgr) publishTx(domainName string, rawTx *RawTx) {
+	if len(vm.vaults) == 0 {
+		return
+	}
+
+	vtx := &VaultTx{
+		DomainName: domainName,
+		RawTx:      rawTx,
+	}
+
+	for _, vault := range vm.vaults {
+		vault.PublishTx(vtx)
+	}
+}
@@ -0,0 +1,380 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/plan-systems/plan-go/ctx"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// txLogKeypath is the reserved keypath (under a domain's keyspace) where each merged RawTx is stored, keyed by TID.
+// Since a TID leads with its big endian timestamp, the log iterates in time order.
+const txLogKeypath = "/.txlog/"
+
+// chTxLogKeypath is the reserved keypath (under a domain's keyspace) that indexes the tx log by channel.
+// Each key is a channel LID followed by the TID of a tx merged into that channel, so a channel's txns iterate in time order.
+const chTxLogKeypath = "/.chlog/"
+
+// mergeLogKeypath is the reserved keypath (under a domain's keyspace) that lists the TID of each tx merged into the domain, keyed by big endian merge seq.
+// Unlike the tx log, it iterates in the order txns were merged, so a feed resumed from a merge seq can't miss a tx that was authored long ago but merged late.
+const mergeLogKeypath = "/.mergelog/"
+
+// txFeedBacklog is the number of newly merged txns a txFeed buffers before it is considered to have fallen behind.
+const txFeedBacklog = 64
+
+// txFeed streams a domain's merge log (or a single channel's tx log) and then optionally remains open for newly merged txns.
+//
+// A domain feed starts after a given merge seq and sends each tx exactly once, in merge order.
+// A channel feed starts after a given TID and is at-least-once: a tx merged while the log is being read may be sent twice.
+type txFeed struct {
+	ctx.Context
+
+	domain        *domain
+	chID          string
+	chLID         LID
+	reader        []byte // pub key of the member reading (channel feeds only -- see checkReadAccess)
+	fromTID       TID
+	afterSeq      uint64 // merge seq of the last tx sent (domain feeds only)
+	maintainSync  bool
+	recheckRights int32 // set (atomically) when a tx changing the reader's ACL entry is merged
+	outbox        chan *VaultTx
+	inbox         chan *VaultTx
+}
+
+// txLogKey returns the db key of the tx log entry for the given TID.
+func (d *domain) txLogKey(tid TID) []byte {
+	key := make([]byte, 0, len(d.keyPrefix)+len(txLogKeypath)+len(tid))
+	return append(append(append(key, d.keyPrefix...), txLogKeypath...), tid...)
+}
+
+// chTxLogKey returns the db key of the given channel's tx log index entry for the given TID.
+func (d *domain) chTxLogKey(chLID LID, tid TID) []byte {
+	key := make([]byte, 0, len(d.keyPrefix)+len(chTxLogKeypath)+lidKeySz+1+len(tid))
+	key = append(appendLIDKey(append(append(key, d.keyPrefix...), chTxLogKeypath...), chLID), '/')
+	return append(key, tid...)
+}
+
+// mergeLogPrefix returns the db key prefix of this domain's merge log.
+func (d *domain) mergeLogPrefix() []byte {
+	key := make([]byte, 0, len(d.keyPrefix)+len(mergeLogKeypath)+8)
+	return append(append(key, d.keyPrefix...), mergeLogKeypath...)
+}
+
+// mergeLogKey returns the db key of the merge log entry for the given merge seq.
+func (d *domain) mergeLogKey(seq uint64) []byte {
+	var seqBuf [8]byte
+	binary.BigEndian.PutUint64(seqBuf[:], seq)
+	return append(d.mergeLogPrefix(), seqBuf[:]...)
+}
+
+// readMergeSeq returns the merge seq of the last tx merged into this domain (or 0 if none have been).
+func (d *domain) readMergeSeq() (uint64, error) {
+	var seq uint64
+
+	err := d.stateDB.View(func(dbTx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		opts.Prefix = d.mergeLogPrefix()
+		itr := dbTx.NewIterator(opts)
+		defer itr.Close()
+
+		itr.Seek(d.mergeLogKey(^uint64(0)))
+		if itr.Valid() {
+			key := itr.Item().Key()
+			seq = binary.BigEndian.Uint64(key[len(opts.Prefix):])
+		}
+		return nil
+	})
+
+	return seq, err
+}
+
+// OpenTxFeed -- see interface Host
+func (d *domain) OpenTxFeed(afterSeq uint64) (TxFeed, error) {
+	return d.openTxFeed("", nil, afterSeq, true, nil)
+}
+
+// OpenChTxFeed -- see interface Host
+func (d *domain) OpenChTxFeed(chID string, fromTID TID, maintainSync bool, reader MemberSession) (TxFeed, error) {
+	return d.openTxFeed(chID, fromTID, 0, maintainSync, readerKey(reader))
+}
+
+func (d *domain) openTxFeed(chID string, fromTID TID, afterSeq uint64, maintainSync bool, reader []byte) (TxFeed, error) {
+	var chLID LID
+
+	// Txns name the ChID of each channel they write to, so a feed opened via an alias must match on the channel's ChID instead
+	if len(chID) > 0 {
+		var err error
+		chLID, err = d.lookupCh(chID)
+		if err == nil {
+			chID, err = d.chLIDs.primaryName(chLID)
+		}
+		if err == nil {
+			err = d.checkReadAccess(chLID, chID, reader)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	feed := &txFeed{
+		domain:       d,
+		chID:         chID,
+		chLID:        chLID,
+		reader:       reader,
+		fromTID:      fromTID,
+		afterSeq:     afterSeq,
+		maintainSync: maintainSync,
+		outbox:       make(chan *VaultTx),
+		inbox:        make(chan *VaultTx, txFeedBacklog),
+	}
+
+	err := feed.CtxStart(
+		feed.ctxStartup,
+		nil,
+		nil,
+		feed.ctxStopping,
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.CtxAddChild(feed, nil)
+
+	return feed, nil
+}
+
+func (d *domain) registerFeed(feed *txFeed) {
+	d.feedsMu.Lock()
+	d.feeds = append(d.feeds, feed)
+	d.feedsMu.Unlock()
+}
+
+func (d *domain) unregisterFeed(remove *txFeed) {
+	d.feedsMu.Lock()
+	N := len(d.feeds)
+	for i := 0; i < N; i++ {
+		if d.feeds[i] == remove {
+			N--
+			d.feeds[i] = d.feeds[N]
+			d.feeds[N] = nil
+			d.feeds = d.feeds[:N]
+			break
+		}
+	}
+	d.feedsMu.Unlock()
+}
+
+// broadcastToFeeds sends the given newly merged Tx (and its merge seq) to each open txFeed of its domain or of a channel it writes to.
+// A feed that has fallen behind is stopped (rather than blocking the merge loop), leaving its consumer to resume from the last tx it received.
+func (d *domain) broadcastToFeeds(tx *Tx, seq uint64) {
+	vtx := &VaultTx{
+		DomainName: d.domainName,
+		RawTx:      tx.RawTx,
+		MergeSeq:   seq,
+	}
+
+	d.feedsMu.RLock()
+	for _, feed := range d.feeds {
+		if len(feed.chID) > 0 && tx.TxOp.WritesToCh(feed.chID) == false {
+			continue
+		}
+		if len(feed.chID) > 0 && writesACLEntry(tx.TxOp, feed.chID, feed.reader) {
+			atomic.StoreInt32(&feed.recheckRights, 1)
+		}
+		select {
+		case feed.inbox <- vtx:
+		default:
+			go feed.CtxStop("tx feed fell behind", nil)
+		}
+	}
+	d.feedsMu.RUnlock()
+}
+
+// writesACLEntry returns true if the given TxOp writes the ACL entry of the member with the given pub key in the given channel.
+func writesACLEntry(txOp *TxOp, chID string, pubKey []byte) bool {
+	keypath := aclKeypathFor(pubKey)
+	writes := func(entries []*Node) bool {
+		for _, entry := range entries {
+			if entry.Keypath == keypath {
+				return true
+			}
+		}
+		return false
+	}
+
+	if txOp.ChStateURI.ChID == chID && writes(txOp.Entries) {
+		return true
+	}
+	for _, chEntries := range txOp.ChEntries {
+		if chEntries.ChID == chID && writes(chEntries.Entries) {
+			return true
+		}
+	}
+	return false
+}
+
+// Outbox -- see interface TxFeed
+func (feed *txFeed) Outbox() <-chan *VaultTx {
+	return feed.outbox
+}
+
+// Close -- see interface TxFeed
+func (feed *txFeed) Close() {
+	feed.CtxStop("tx feed closed", nil)
+}
+
+func (feed *txFeed) ctxStartup() error {
+	if len(feed.chID) > 0 {
+		feed.SetLogLabelf("%s/…%s feed", feed.domain.domainName, feed.chID[len(feed.chID)-5:])
+	} else {
+		feed.SetLogLabelf("%s feed", feed.domain.domainName)
+	}
+
+	// Register before reading the log so that no newly merged txns are missed
+	if feed.maintainSync {
+		feed.domain.registerFeed(feed)
+	}
+
+	feed.CtxGo(func() {
+		if len(feed.chID) > 0 {
+			feed.sendChLog()
+		} else {
+			feed.sendMergeLog()
+		}
+
+		if feed.maintainSync {
+			for vtx := range feed.inbox {
+
+				// A domain feed skips txns already sent from the merge log
+				if len(feed.chID) == 0 {
+					if vtx.MergeSeq <= feed.afterSeq {
+						continue
+					}
+					feed.afterSeq = vtx.MergeSeq
+				}
+				feed.send(vtx)
+			}
+		}
+
+		close(feed.outbox)
+
+		if feed.maintainSync == false {
+			feed.CtxStop("tx log sent", nil)
+		}
+	})
+
+	return nil
+}
+
+func (feed *txFeed) ctxStopping() {
+	if feed.maintainSync {
+		feed.domain.unregisterFeed(feed)
+	}
+	close(feed.inbox)
+}
+
+func (feed *txFeed) send(vtx *VaultTx) {
+
+	// Nothing more is sent once the reader's ReadAccess is revoked (including the revoking tx)
+	if atomic.SwapInt32(&feed.recheckRights, 0) != 0 && feed.domain.checkReadAccess(feed.chLID, feed.chID, feed.reader) != nil {
+		feed.CtxStop(readAccessRevoked, nil)
+	}
+	if feed.CtxRunning() == false {
+		return
+	}
+
+	select {
+	case feed.outbox <- vtx:
+	case <-feed.CtxStopping():
+	}
+}
+
+// sendMergeLog sends each RawTx in the domain's merge log with a merge seq after feed.afterSeq.
+func (feed *txFeed) sendMergeLog() {
+	d := feed.domain
+	logPrefix := d.mergeLogPrefix()
+
+	readTxn := d.stateDB.NewTransaction(false)
+	defer readTxn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = logPrefix
+	itr := readTxn.NewIterator(opts)
+	defer itr.Close()
+
+	for itr.Seek(d.mergeLogKey(feed.afterSeq + 1)); itr.Valid(); itr.Next() {
+		if feed.CtxRunning() == false {
+			break
+		}
+
+		item := itr.Item()
+		vtx := &VaultTx{
+			DomainName: d.domainName,
+			RawTx:      &RawTx{},
+			MergeSeq:   binary.BigEndian.Uint64(item.Key()[len(logPrefix):]),
+		}
+		var err error
+		vtx.RawTx.TID, err = item.ValueCopy(nil)
+		if err == nil {
+			item, err = readTxn.Get(d.txLogKey(vtx.RawTx.TID))
+		}
+		if err == nil {
+			vtx.RawTx.Bytes, err = item.ValueCopy(nil)
+		}
+		if err != nil {
+			feed.Errorf("failed to read tx log entry %v: %v", TID(vtx.RawTx.TID).SuffixStr(), err)
+			continue
+		}
+
+		feed.send(vtx)
+		feed.afterSeq = vtx.MergeSeq
+	}
+}
+
+// sendChLog sends each RawTx in the channel's tx log with a TID after feed.fromTID.
+func (feed *txFeed) sendChLog() {
+	d := feed.domain
+	indexPrefix := d.chTxLogKey(feed.chLID, nil)
+	seekKey := d.chTxLogKey(feed.chLID, feed.fromTID)
+
+	readTxn := d.stateDB.NewTransaction(false)
+	defer readTxn.Discard()
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = indexPrefix
+	itr := readTxn.NewIterator(opts)
+	defer itr.Close()
+
+	for itr.Seek(seekKey); itr.Valid(); itr.Next() {
+		if feed.CtxRunning() == false {
+			break
+		}
+
+		key := itr.Item().Key()
+		if bytes.Equal(key, seekKey) {
+			continue
+		}
+
+		rawTx := &RawTx{
+			TID: append([]byte{}, key[len(indexPrefix):]...),
+		}
+		item, err := readTxn.Get(d.txLogKey(rawTx.TID))
+		if err == nil {
+			rawTx.Bytes, err = item.ValueCopy(nil)
+		}
+		if err != nil {
+			feed.Errorf("failed to read tx log entry %v: %v", TID(rawTx.TID).SuffixStr(), err)
+			continue
+		}
+
+		feed.send(&VaultTx{
+			DomainName: d.domainName,
+			RawTx:      rawTx,
+		})
+	}
+}
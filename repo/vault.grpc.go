@@ -0,0 +1,337 @@
+package repo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/plan-systems/plan-go/ctx"
+)
+
+const (
+
+	// vaultRetryDelay is how long a grpcVault waits before reconnecting a dropped domain feed.
+	vaultRetryDelay = 3 * time.Second
+
+	// vaultAckBacklog is the number of txns received over a vault session that can be awaiting merge before receiving blocks.
+	vaultAckBacklog = 256
+
+	// vaultEchoWindow is the number of txns received over a vault session that are remembered so that they aren't sent back over it.
+	vaultEchoWindow = 1024
+)
+
+// grpcVault is a Vault that replicates a set of domains with a peer pnode over gRPC (see GrpcServer.VaultSession).
+type grpcVault struct {
+	ctx.Context
+
+	peerAddr string
+	vaultID  string
+	host     VaultHost
+	conn     *grpc.ClientConn
+	links    map[string]*vaultLink
+}
+
+// vaultLink replicates a single domain between a grpcVault and its peer.
+type vaultLink struct {
+	vault       *grpcVault
+	domainName  string
+	cursor      VaultCursor
+	cursorDirty bool
+	cursorMu    sync.Mutex
+}
+
+// NewGrpcVault returns a Vault that replicates each of the given domains with the pnode at peerAddr.
+// For each domain, the peer's merge log is received from it and this host's merge log is sent to it (see serveStream).
+//
+// Where each domain left off is saved (see VaultCursor), so that replication resumes without loss following a dropped session or a restart.
+func NewGrpcVault(peerAddr string, domainNames []string) Vault {
+	gv := &grpcVault{
+		peerAddr: peerAddr,
+		vaultID:  "grpc:" + peerAddr,
+		links:    make(map[string]*vaultLink, len(domainNames)),
+	}
+
+	for _, domainName := range domainNames {
+		gv.links[domainName] = &vaultLink{
+			vault:      gv,
+			domainName: domainName,
+		}
+	}
+
+	return gv
+}
+
+// Start -- see interface Vault
+func (gv *grpcVault) Start(host VaultHost) error {
+	gv.host = host
+
+	return gv.CtxStart(
+		gv.ctxStartup,
+		nil,
+		nil,
+		gv.ctxStopping,
+	)
+}
+
+func (gv *grpcVault) ctxStartup() error {
+	gv.SetLogLabelf("vault %v", gv.peerAddr)
+
+	var err error
+	gv.conn, err = grpc.Dial(gv.peerAddr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+
+	for _, link := range gv.links {
+		link.cursor, err = gv.host.ReadVaultCursor(gv.vaultID, link.domainName)
+		if err != nil {
+			return err
+		}
+
+		link := link
+		gv.CtxGo(link.replicate)
+	}
+
+	// Periodically save each domain cursor rather than with every tx received
+	gv.CtxGo(func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for running := true; running; {
+			select {
+			case <-ticker.C:
+			case <-gv.CtxStopping():
+				running = false
+			}
+			for _, link := range gv.links {
+				link.saveCursor()
+			}
+		}
+	})
+
+	return nil
+}
+
+func (gv *grpcVault) ctxStopping() {
+	gv.conn.Close()
+}
+
+// PublishTx -- see interface Vault
+//
+// Locally authored txns are instead sent from the host's merge log once merged (see serveStream), so none are lost while the peer is unreachable.
+func (gv *grpcVault) PublishTx(vtx *VaultTx) {
+}
+
+// replicate maintains a session with the peer for this link's domain, reconnecting until the vault is stopped.
+func (link *vaultLink) replicate() {
+	gv := link.vault
+
+	for gv.CtxRunning() {
+		err := link.serveStream()
+		if err != nil && gv.CtxRunning() {
+			gv.Warnf("%v session dropped: %v", link.domainName, err)
+		}
+
+		select {
+		case <-time.After(vaultRetryDelay):
+		case <-gv.CtxStopping():
+		}
+	}
+}
+
+// serveStream opens a single vault session with the peer for this link's domain, returning once the session ends.
+//
+// The peer sends its merge log following cursor.RecvSeq while this host's merge log following cursor.SentSeq is sent to the peer.
+// Each side of the cursor only advances once the receiving host has merged (or rejected) a tx, so any tx in flight when a session drops is sent again.
+func (link *vaultLink) serveStream() error {
+	gv := link.vault
+	cursor := link.readCursor()
+
+	sessCtx, endSess := context.WithCancel(gv)
+	defer endSess()
+
+	rpc, err := NewRepoGrpcClient(gv.conn).VaultSession(sessCtx)
+	if err != nil {
+		return err
+	}
+
+	err = rpc.Send(&VaultTx{
+		DomainName:   link.domainName,
+		FeedAfterSeq: cursor.RecvSeq,
+	})
+	if err != nil {
+		return err
+	}
+
+	feed, err := gv.host.OpenTxFeed(link.domainName, cursor.SentSeq)
+	if err != nil {
+		return err
+	}
+	defer feed.Close()
+
+	// Send this host's merge log (except txns that came from the peer) until the session ends.
+	// If the feed stops first (e.g. it fell behind), the session is ended so that it resumes from the acknowledged cursor.
+	var echoes vaultEchoes
+	go func() {
+		for vtx := range feed.Outbox() {
+			if echoes.take(vtx.RawTx.TID) {
+				continue
+			}
+			err := rpc.Send(&VaultTx{
+				DomainName: link.domainName,
+				RawTx:      vtx.RawTx,
+				MergeSeq:   vtx.MergeSeq,
+			})
+			if err != nil {
+				break
+			}
+		}
+		endSess()
+	}()
+
+	// Advance the cursor past each received tx once it is merged
+	received := make(chan pendingVaultTx, vaultAckBacklog)
+	ackDone := make(chan struct{})
+	go func() {
+		err := ackInOrder(received, func(pending pendingVaultTx) error {
+			link.updateCursor(func(cursor *VaultCursor) {
+				if pending.seq > cursor.RecvSeq {
+					cursor.RecvSeq = pending.seq
+				}
+			})
+			return nil
+		})
+		if err != nil {
+			gv.Warnf("%v session ending: %v", link.domainName, err)
+			endSess()
+		}
+		close(ackDone)
+	}()
+	defer func() {
+		close(received)
+		<-ackDone
+	}()
+
+	for {
+		vtx, err := rpc.Recv()
+		if err != nil {
+			return err
+		}
+
+		// The peer acknowledges each tx sent to it once merged
+		if vtx.AckSeq > 0 {
+			link.updateCursor(func(cursor *VaultCursor) {
+				if vtx.AckSeq > cursor.SentSeq {
+					cursor.SentSeq = vtx.AckSeq
+				}
+			})
+		}
+		if vtx.RawTx == nil {
+			continue
+		}
+
+		echoes.add(vtx.RawTx.TID)
+		vtx.DomainName = link.domainName
+		txDone, err := gv.host.ReceiveTx(vtx)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case received <- pendingVaultTx{
+			domainName: link.domainName,
+			seq:        vtx.MergeSeq,
+			txDone:     txDone,
+		}:
+		case <-sessCtx.Done():
+			return sessCtx.Err()
+		}
+	}
+}
+
+func (link *vaultLink) readCursor() VaultCursor {
+	link.cursorMu.Lock()
+	defer link.cursorMu.Unlock()
+
+	return link.cursor
+}
+
+func (link *vaultLink) updateCursor(update func(cursor *VaultCursor)) {
+	link.cursorMu.Lock()
+	prev := link.cursor
+	update(&link.cursor)
+	if link.cursor != prev {
+		link.cursorDirty = true
+	}
+	link.cursorMu.Unlock()
+}
+
+func (link *vaultLink) saveCursor() {
+	link.cursorMu.Lock()
+	defer link.cursorMu.Unlock()
+
+	if link.cursorDirty {
+		err := link.vault.host.SaveVaultCursor(link.vault.vaultID, link.domainName, link.cursor)
+		if err != nil {
+			link.vault.Warnf("failed to save %v cursor: %v", link.domainName, err)
+		} else {
+			link.cursorDirty = false
+		}
+	}
+}
+
+// pendingVaultTx is a tx received over a vault session that is awaiting merge.
+type pendingVaultTx struct {
+	domainName string
+	seq        uint64 // merge seq of the tx on the sending host
+	txDone     TxCompletion
+}
+
+// ackInOrder waits on each pending tx in the order received, passing it to ack once it is merged (or rejected) so that the sender's cursor can advance past it.
+//
+// It returns once pending is closed, or returns an error as soon as a tx is dropped without being merged (e.g. its domain stopped).
+// No later tx is then acknowledged, since the sender must send that tx (and every tx after it) again.
+func ackInOrder(pending <-chan pendingVaultTx, ack func(pending pendingVaultTx) error) error {
+	for tx := range pending {
+		<-tx.txDone.Done()
+		if err := tx.txDone.Err(); err != nil && toReqErr(err).Code == ErrCode_ReqCanceled {
+			return err
+		}
+		if tx.seq == 0 {
+			continue
+		}
+		if err := ack(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vaultEchoes holds the TIDs of txns received over a vault session so that they aren't sent back over it.
+// Once vaultEchoWindow TIDs are held, older TIDs are forgotten, in which case a tx may be sent back once (and is ignored by the peer since it is already merged there).
+type vaultEchoes struct {
+	mu   sync.Mutex
+	tids map[string]struct{}
+}
+
+func (echoes *vaultEchoes) add(tid TID) {
+	echoes.mu.Lock()
+	if len(echoes.tids) >= vaultEchoWindow || echoes.tids == nil {
+		echoes.tids = make(map[string]struct{})
+	}
+	echoes.tids[string(tid)] = struct{}{}
+	echoes.mu.Unlock()
+}
+
+// take returns true if the given TID was received over this session, forgetting it.
+func (echoes *vaultEchoes) take(tid TID) bool {
+	echoes.mu.Lock()
+	_, received := echoes.tids[string(tid)]
+	if received {
+		delete(echoes.tids, string(tid))
+	}
+	echoes.mu.Unlock()
+	return received
+}
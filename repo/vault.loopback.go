@@ -0,0 +1,138 @@
+package repo
+
+import (
+	"sync"
+
+	"github.com/plan-systems/plan-go/ctx"
+)
+
+// LoopbackHub relays txns between the Vaults it issues, allowing multiple Hosts in the same process to replicate with each other.
+type LoopbackHub struct {
+	vaultsMu sync.RWMutex
+	vaults   []*loopbackVault
+}
+
+// loopbackBacklog is the number of relayed txns a loopbackVault queues before it is considered to have fallen behind.
+const loopbackBacklog = 256
+
+// NewLoopbackHub creates a new LoopbackHub, typically for testing.
+func NewLoopbackHub() *LoopbackHub {
+	return &LoopbackHub{}
+}
+
+// NewVault issues a new Vault attached to this hub.
+// Txns published by the returned Vault are received by every other Vault attached to this hub.
+func (hub *LoopbackHub) NewVault() Vault {
+	return &loopbackVault{
+		hub:     hub,
+		inbound: make(chan *VaultTx, loopbackBacklog),
+	}
+}
+
+func (hub *LoopbackHub) attach(lv *loopbackVault) {
+	hub.vaultsMu.Lock()
+	hub.vaults = append(hub.vaults, lv)
+	hub.vaultsMu.Unlock()
+}
+
+func (hub *LoopbackHub) detach(remove *loopbackVault) {
+	hub.vaultsMu.Lock()
+	N := len(hub.vaults)
+	for i := 0; i < N; i++ {
+		if hub.vaults[i] == remove {
+			N--
+			hub.vaults[i] = hub.vaults[N]
+			hub.vaults[N] = nil
+			hub.vaults = hub.vaults[:N]
+			break
+		}
+	}
+	hub.vaultsMu.Unlock()
+}
+
+// relay queues the given tx for each vault attached to this hub (other than the vault it is from).
+// This is called from a merge worker (see vaultMgr.publishTx), so it never blocks: a vault that has fallen behind is stopped instead.
+func (hub *LoopbackHub) relay(from *loopbackVault, vtx *VaultTx) {
+	hub.vaultsMu.RLock()
+	targets := make([]*loopbackVault, 0, len(hub.vaults))
+	for _, lv := range hub.vaults {
+		if lv != from {
+			targets = append(targets, lv)
+		}
+	}
+	hub.vaultsMu.RUnlock()
+
+	for _, lv := range targets {
+		lv.enqueue(vtx)
+	}
+}
+
+// loopbackVault is an in-process Vault issued by a LoopbackHub.
+type loopbackVault struct {
+	ctx.Context
+
+	hub       *LoopbackHub
+	host      VaultHost
+	inbound   chan *VaultTx // nil once this vault is stopping
+	inboundMu sync.RWMutex
+}
+
+// Start -- see interface Vault
+func (lv *loopbackVault) Start(host VaultHost) error {
+	lv.host = host
+
+	return lv.CtxStart(
+		lv.ctxStartup,
+		nil,
+		nil,
+		lv.ctxStopping,
+	)
+}
+
+func (lv *loopbackVault) ctxStartup() error {
+	lv.SetLogLabel("loopback vault")
+
+	inbound := lv.inbound
+	lv.CtxGo(func() {
+		for vtx := range inbound {
+			_, err := lv.host.ReceiveTx(vtx)
+			if err != nil {
+				lv.Warnf("failed to receive Tx %v: %v", TID(vtx.RawTx.TID).SuffixStr(), err)
+			}
+		}
+	})
+
+	lv.hub.attach(lv)
+	return nil
+}
+
+func (lv *loopbackVault) ctxStopping() {
+
+	// Once detached, the hub no longer relays to this vault, but a relay already underway may still be enqueuing
+	lv.hub.detach(lv)
+	lv.inboundMu.Lock()
+	close(lv.inbound)
+	lv.inbound = nil
+	lv.inboundMu.Unlock()
+}
+
+// enqueue queues the given tx to be received by this vault's host, stopping this vault if it has fallen behind.
+func (lv *loopbackVault) enqueue(vtx *VaultTx) {
+	lv.inboundMu.RLock()
+	defer lv.inboundMu.RUnlock()
+
+	if lv.inbound == nil {
+		return
+	}
+	select {
+	case lv.inbound <- vtx:
+	default:
+		lv.Warnf("dropping Tx %v", TID(vtx.RawTx.TID).SuffixStr())
+		go lv.CtxStop("loopback vault fell behind", nil)
+	}
+}
+
+// PublishTx -- see interface Vault
+func (lv *loopbackVault) PublishTx(vtx *VaultTx) {
+	lv.hub.relay(lv, vtx)
+}
@@ -0,0 +1,456 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"google.golang.org/grpc"
+)
+
+// testTimeout is how long a test waits on an outcome before failing.
+const testTimeout = 5 * time.Second
+
+func TestLoopbackVault(t *testing.T) {
+	hub := NewLoopbackHub()
+	A := startTestHost(t, hub.NewVault())
+	B := startTestHost(t, hub.NewVault())
+
+	alice := newTestMember(t, A, "alice")
+	bob := newTestMember(t, B, "bob")
+
+	// 1) Author a new channel on A
+	genesis, err := alice.EncodeToTxAndSign(&TxOp{
+		ChStateURI: &ChStateURI{
+			DomainName: "test-domain",
+		},
+		ChannelGenesis: true,
+		Entries: []*Node{
+			&Node{
+				Keypath: "posts/hello",
+				Str:     "hello, PLAN community!",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := genesis.TxOp.ChStateURI
+
+	// Once the channel (and Bob's rights to read it) has replicated to B, subscribe there so that each further entry is seen as it arrives
+	submitTestTx(t, A, genesis)
+	waitForMerge(t, B, grantTestRights(t, A, alice, uri, bob, ReadAccess))
+
+	sub, err := B.OpenChSub(&ChReq{
+		ChStateURI: &ChStateURI{
+			DomainName: uri.DomainName,
+			ChID:       uri.ChID,
+			ChID_TID:   uri.ChID_TID,
+		},
+		GetOp: &GetOp{
+			Keypath:      "posts",
+			Scope:        KeypathScope_Shallow,
+			MaintainSync: true,
+		},
+	}, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// 2) Author an additional entry in the new channel on A
+	tx, err := alice.EncodeToTxAndSign(&TxOp{
+		ChStateURI: &ChStateURI{
+			DomainName: uri.DomainName,
+			ChID:       uri.ChID,
+			ChID_TID:   uri.ChID_TID,
+		},
+		Entries: []*Node{
+			&Node{
+				Keypath: "posts/again",
+				Str:     "hello again",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitTestTx(t, A, tx)
+
+	// 3) Both entries should replicate to B
+	nodes := make(map[string]string)
+	timeout := time.After(testTimeout)
+	for len(nodes) < 2 {
+		select {
+		case node := <-sub.Outbox():
+			if node.Op == NodeOp_NodeUpdate {
+				nodes[node.Keypath] = node.Str
+			}
+		case <-timeout:
+			t.Fatalf("expected 2 replicated nodes, got %d", len(nodes))
+		}
+	}
+	if nodes["posts/hello"] != "hello, PLAN community!" {
+		t.Fatalf("unexpected node value %q", nodes["posts/hello"])
+	}
+}
+
+func TestLoopbackRelayDoesntBlock(t *testing.T) {
+	hub := NewLoopbackHub()
+	A := startTestHost(t, hub.NewVault())
+	alice := newTestMember(t, A, "alice")
+
+	// Attach a vault that never receives, as if its host were stalled
+	stalled := hub.NewVault().(*loopbackVault)
+	hub.attach(stalled)
+	defer hub.detach(stalled)
+
+	// Merging isn't held up once its queue fills
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	for i := 0; i < loopbackBacklog+10; i++ {
+		submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: fmt.Sprintf("posts/val%03d", i), Int: int64(i)}))
+	}
+}
+
+func TestTxFeedMergeOrder(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	// A tx authored first but merged last must follow in a feed resumed from the seq of the last tx received
+	older := signTestTx(t, alice, uri, &Node{Keypath: "posts/older", Str: "older"})
+	newer := signTestTx(t, alice, uri, &Node{Keypath: "posts/newer", Str: "newer"})
+	submitTestTx(t, A, newer)
+	submitTestTx(t, A, older)
+
+	feed, err := A.OpenTxFeed(testDomain, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	select {
+	case vtx := <-feed.Outbox():
+		if bytes.Equal(vtx.RawTx.TID, older.TID) == false || vtx.MergeSeq != 3 {
+			t.Fatalf("expected tx %v at merge seq 3, got %v at %d", TID(older.TID).SuffixStr(), TID(vtx.RawTx.TID).SuffixStr(), vtx.MergeSeq)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for tx feed")
+	}
+}
+
+func TestChTxFeed(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	other, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/other", Str: "other"})
+
+	first := signTestTx(t, alice, uri, &Node{Keypath: "posts/first", Str: "first"})
+	second := signTestTx(t, alice, uri, &Node{Keypath: "posts/second", Str: "second"})
+	submitTestTx(t, A, first)
+	submitTestTx(t, A, second)
+	submitTestTx(t, A, signTestTx(t, alice, other, &Node{Keypath: "posts/skipped", Str: "skipped"}))
+
+	// A tx written to the channel via ChEntries is in its log too
+	multi, err := alice.EncodeToTxAndSign(&TxOp{
+		ChStateURI: other,
+		Entries:    []*Node{{Keypath: "posts/multi", Str: "multi"}},
+		ChEntries:  []*ChEntries{{ChID_TID: uri.ChID_TID, Entries: []*Node{{Keypath: "posts/multi", Str: "multi"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitTestTx(t, A, multi)
+
+	feed, err := A.OpenChTxFeed(uri, first.TID, true, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	// Txns after the given TID follow, and then those merged once the feed is caught up
+	live := signTestTx(t, alice, uri, &Node{Keypath: "posts/live", Str: "live"})
+	for i, expect := range []*Tx{second, multi, live} {
+		if i == 2 {
+			submitTestTx(t, A, live)
+		}
+		select {
+		case vtx := <-feed.Outbox():
+			if bytes.Equal(vtx.RawTx.TID, expect.TID) == false {
+				t.Fatalf("expected tx %v, got %v", TID(expect.TID).SuffixStr(), TID(vtx.RawTx.TID).SuffixStr())
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for tx feed")
+		}
+	}
+}
+
+func TestVaultCursor(t *testing.T) {
+	A := startTestHost(t).(*host)
+	vm := A.vaultMgr
+
+	cursor := VaultCursor{RecvSeq: 7, SentSeq: 3}
+	if err := vm.SaveVaultCursor("test", testDomain, cursor); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := vm.ReadVaultCursor("test", testDomain); err != nil || stored != cursor {
+		t.Fatalf("expected cursor %v, got %v (%v)", cursor, stored, err)
+	}
+
+	// A cursor in an earlier format reads as a zero cursor
+	err := A.stateDB.Update(func(dbTx *badger.Txn) error {
+		return dbTx.Set(vaultCursorKey("test", testDomain), make([]byte, TIDSz))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := vm.ReadVaultCursor("test", testDomain); err != nil || stored != (VaultCursor{}) {
+		t.Fatalf("expected zero cursor, got %v (%v)", stored, err)
+	}
+}
+
+func TestVaultSession(t *testing.T) {
+	A := startTestHost(t)
+	B := startTestHost(t)
+	alice := newTestMember(t, B, "alice")
+
+	uri, genesis := newTestChannel(t, B, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+	tx := signTestTx(t, alice, uri, &Node{Keypath: "posts/again", Str: "hello again"})
+	submitTestTx(t, B, tx)
+
+	rpc, sessDone := startTestVaultSession(t, A)
+
+	// B pushes its txns to A and requests A's merge log
+	rpc.fromPeer <- &VaultTx{DomainName: testDomain, RawTx: genesis.RawTx, MergeSeq: 1}
+	rpc.fromPeer <- &VaultTx{DomainName: testDomain, FeedAfterSeq: 0}
+	rpc.fromPeer <- &VaultTx{DomainName: testDomain, RawTx: tx.RawTx, MergeSeq: 2}
+
+	// Each pushed tx is acknowledged, but is not sent back
+	expectAck := uint64(1)
+	for expectAck <= 2 {
+		vtx := rpc.next(t)
+		if vtx.RawTx != nil || vtx.AckSeq != expectAck {
+			t.Fatalf("expected ack %d, got %+v", expectAck, vtx)
+		}
+		expectAck++
+	}
+
+	// A tx newly merged on A is sent to B
+	txA := signTestTx(t, alice, uri, &Node{Keypath: "posts/from-a", Str: "from A"})
+	submitTestTx(t, A, txA)
+	if vtx := rpc.next(t); vtx.RawTx == nil || bytes.Equal(vtx.RawTx.TID, txA.TID) == false || vtx.MergeSeq != 3 {
+		t.Fatalf("expected tx %v at merge seq 3, got %+v", TID(txA.TID).SuffixStr(), vtx)
+	}
+
+	close(rpc.fromPeer)
+	if err := <-sessDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultSessionEndsWhenFeedFallsBehind(t *testing.T) {
+	A := startTestHost(t)
+	alice := newTestMember(t, A, "alice")
+
+	uri, _ := newTestChannel(t, A, alice, &Node{Keypath: "posts/hello", Str: "hello"})
+
+	rpc, sessDone := startTestVaultSession(t, A)
+	rpc.fromPeer <- &VaultTx{DomainName: testDomain, FeedAfterSeq: 1}
+
+	// Merge more txns than the feed can buffer while the peer isn't receiving
+	for i := 0; i < 2*txFeedBacklog; i++ {
+		submitTestTx(t, A, signTestTx(t, alice, uri, &Node{Keypath: "posts/count", Int: int64(i)}))
+	}
+
+	// The session must end with an error so the peer resumes from its cursor
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case <-rpc.toPeer:
+		case err := <-sessDone:
+			if err == nil {
+				t.Fatal("expected vault session to end with an error")
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for vault session to end")
+		}
+	}
+}
+
+// testVaultRPC is an in-process RepoGrpc_VaultSessionServer, standing in for a peer vault.
+type testVaultRPC struct {
+	grpc.ServerStream
+
+	ctx      context.Context
+	fromPeer chan *VaultTx
+	toPeer   chan *VaultTx
+}
+
+// startTestVaultSession serves a vault session on the given host, returning the session's rpc and a channel that receives its outcome.
+func startTestVaultSession(t *testing.T, host Host) (*testVaultRPC, <-chan error) {
+	rpcCtx, cancel := context.WithCancel(context.Background())
+	rpc := &testVaultRPC{
+		ctx:      rpcCtx,
+		fromPeer: make(chan *VaultTx),
+		toPeer:   make(chan *VaultTx),
+	}
+
+	// As with gRPC, the rpc's context ends once the session is no longer being served
+	sessDone := make(chan error, 1)
+	go func() {
+		err := NewGrpcServer(host, "", "").VaultSession(rpc)
+		cancel()
+		sessDone <- err
+	}()
+	t.Cleanup(cancel)
+
+	return rpc, sessDone
+}
+
+func (rpc *testVaultRPC) Send(vtx *VaultTx) error {
+	select {
+	case rpc.toPeer <- vtx:
+		return nil
+	case <-rpc.ctx.Done():
+		return rpc.ctx.Err()
+	}
+}
+
+func (rpc *testVaultRPC) Recv() (*VaultTx, error) {
+	select {
+	case vtx, ok := <-rpc.fromPeer:
+		if ok == false {
+			return nil, io.EOF
+		}
+		return vtx, nil
+	case <-rpc.ctx.Done():
+		return nil, rpc.ctx.Err()
+	}
+}
+
+func (rpc *testVaultRPC) Context() context.Context {
+	return rpc.ctx
+}
+
+// next returns the next msg sent to the peer.
+func (rpc *testVaultRPC) next(t *testing.T) *VaultTx {
+	select {
+	case vtx := <-rpc.toPeer:
+		return vtx
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for vault session")
+	}
+	return nil
+}
+
+// startTestHost starts a Host in a temp dir (attached to the given vaults) that is stopped when the test completes.
+func startTestHost(t *testing.T, vaults ...Vault) Host {
+	host, err := NewHost(HostParams{
+		BasePath: t.TempDir(),
+		Vaults:   vaults,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = host.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		host.Ctx().CtxStop("test complete", nil)
+		host.Ctx().CtxWait()
+	})
+
+	return host
+}
+
+// newTestMember returns a MemberSession on the given host with access expanded for the given member (and ended when the test completes).
+func newTestMember(t *testing.T, host Host, name string) MemberSession {
+	ms := host.NewSession()
+	err := ms.ExpandAccess(&EnclaveAccess{
+		HiveName:       name,
+		HivePass:       []byte(name + " pass"),
+		SigningKeyring: []byte(name + " signing"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ms.EndSession("test complete")
+	})
+
+	return ms
+}
+
+// submitTestTx submits the given tx to the given host and waits for it to be merged.
+func submitTestTx(t *testing.T, host Host, tx *Tx) {
+	txDone, err := host.SubmitTx(tx)
+	if err == nil {
+		err = waitForTx(t, txDone)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForTx waits for the given tx to be merged or rejected, returning the reason it was rejected.
+func waitForTx(t *testing.T, txDone TxCompletion) error {
+	select {
+	case <-txDone.Done():
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for tx")
+	}
+	return txDone.Err()
+}
+
+// waitForMerge waits for the given tx to be merged on the given host (e.g. once it has replicated there).
+func waitForMerge(t *testing.T, host Host, tx *Tx) {
+	timeout := time.After(testTimeout)
+	for {
+		status, err := host.GetTxStatus(tx.TxOp.ChStateURI.DomainName, tx.TID)
+		if err == nil && status.State == TxState_Merged {
+			return
+		}
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("timed out waiting for tx %v to be merged", TID(tx.TID).SuffixStr())
+		}
+	}
+}
+
+// readState returns the nodes immediately under the given keypath.
+func readState(t *testing.T, host Host, reader MemberSession, uri *ChStateURI, keypath string) []*Node {
+	return readNodes(t, host, reader, &ChReq{
+		ChStateURI: uri,
+		GetOp: &GetOp{
+			Keypath: keypath,
+			Scope:   KeypathScope_Shallow,
+		},
+	})
+}
+
+// readNodes returns the node updates sent for the given (state only) ChReq.
+func readNodes(t *testing.T, host Host, reader MemberSession, chReq *ChReq) []*Node {
+	sub, err := host.OpenChSub(chReq, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nodes []*Node
+	for node := range sub.Outbox() {
+		if node.Op == NodeOp_NodeUpdate {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}